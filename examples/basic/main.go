@@ -38,19 +38,17 @@ func main() {
 		StatsReportInterval: 60,
 	})
 
-	homie.NewDevicePublisher(device)
-
 	publisher, _ = periodicRandomIntPublisher("1s")
 
-	node := device.NewNode("RandomGenerator", "RandomValueGeneratorNode")
+	node := device.NewNode("random-generator", "RandomValueGeneratorNode").SetName("RandomGenerator")
 
 	publisher.AddNodePublisher(node, randomPropertySetter)
 
 	node.NewProperty("value", "integer")
 
-	// to change interval, send a message to: devices/test1/RandomGenerator/interval/set
+	// to change interval, send a message to: devices/test1/random-generator/interval/set
 	// sample intervals: 200ms, 3s
-	node.NewProperty("interval", "integer").
+	node.NewProperty("interval", "string").
 		SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
 			interval := string(payload)
 			publisher.Close() // close current publisher
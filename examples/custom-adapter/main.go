@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	homie "github.com/masgari/homie-go/homie"
+	"github.com/masgari/homie-go/homietest"
+)
+
+// doneToken a token of an operation completed synchronously
+type doneToken struct {
+	err error
+}
+
+func (t *doneToken) Wait() bool                       { return true }
+func (t *doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (t *doneToken) Error() error                     { return t.err }
+
+// message incoming message delivered to subscription handlers
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return 0 }
+func (m *message) Retained() bool    { return false }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
+
+// consoleAdapter a homie.MqttAdapter printing publishes to stdout and reading "<topic> <payload>" lines from stdin
+type consoleAdapter struct {
+	mutex         sync.Mutex
+	connected     bool
+	subscriptions map[string]mqtt.MessageHandler
+}
+
+func (a *consoleAdapter) Connect() mqtt.Token {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.connected = true
+	return &doneToken{}
+}
+
+func (a *consoleAdapter) IsConnected() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.connected
+}
+
+func (a *consoleAdapter) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	fmt.Printf("%s %v\n", topic, payload)
+	return &doneToken{}
+}
+
+func (a *consoleAdapter) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.subscriptions[topic] = callback
+	return &doneToken{}
+}
+
+func (a *consoleAdapter) Disconnect(quiesce uint) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.connected = false
+}
+
+// deliver call handlers of subscriptions matching topic, filters may contain + and # wildcards
+func (a *consoleAdapter) deliver(topic string, payload string) {
+	a.mutex.Lock()
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range a.subscriptions {
+		if homietest.TopicMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	a.mutex.Unlock()
+	if len(handlers) == 0 {
+		fmt.Printf("no subscription for %s\n", topic)
+		return
+	}
+	for _, handler := range handlers {
+		handler(nil, &message{topic: topic, payload: []byte(payload)})
+	}
+}
+
+func main() {
+	adapter := &consoleAdapter{subscriptions: make(map[string]mqtt.MessageHandler)}
+	device := homie.NewDevice("console", &homie.Config{
+		BaseTopic: "devices/",
+	})
+	device.NewNode("light", "Light").
+		NewProperty("on", "boolean").
+		SetValue("false").
+		OnSet(func(value string) error { return nil })
+
+	if err := device.SetClient(adapter).Connect(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// try: devices/console/light/on/set true
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		if len(parts) == 2 {
+			adapter.deliver(parts[0], parts[1])
+		}
+	}
+	device.Disconnect()
+}
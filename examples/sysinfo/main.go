@@ -24,7 +24,7 @@ func formatByteCount(b uint64) string {
 }
 
 func configureMemoryNode(device homie.Device, publisher homie.PeriodicPublisher) {
-	memNode := device.NewNode("Memory", "MemoryNode")
+	memNode := device.NewNode("memory", "MemoryNode").SetName("Memory")
 	memNode.NewProperty("total", "integer")
 	memNode.NewProperty("free", "integer")
 	publisher.AddNodePublisher(memNode, func(n homie.Node) {
@@ -39,7 +39,7 @@ func configureMemoryNode(device homie.Device, publisher homie.PeriodicPublisher)
 }
 
 func configureCPUNode(device homie.Device, publisher homie.PeriodicPublisher) {
-	cpuNode := device.NewNode("CPU", "CPUNode")
+	cpuNode := device.NewNode("cpu", "CPUNode").SetName("CPU")
 	cpuNode.NewProperty("usage", "float")
 	cpuNode.NewProperty("load", "float")
 	publisher.AddNodePublisher(cpuNode, func(n homie.Node) {
@@ -70,6 +70,5 @@ func main() {
 	configureMemoryNode(device, statsPublisher)
 	configureCPUNode(device, statsPublisher)
 
-	homie.NewDevicePublisher(device) // report uptime every 60s
 	device.Run(true)
 }
@@ -1,14 +1,16 @@
 module github.com/masgari/homie-go
 
-go 1.12
+go 1.13
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/prometheus/client_golang v1.1.0
 	github.com/shirou/gopsutil v2.18.12+incompatible
+	gopkg.in/yaml.v2 v2.2.2
 
 	// test
 	github.com/stretchr/objx v0.2.0 // indirect
 	github.com/stretchr/testify v1.3.0
-	golang.org/x/net v0.0.0-20190424112056-4829fb13d2c6 // indirect
+	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980 // indirect
 
 )
@@ -0,0 +1,138 @@
+package homie
+
+// DeviceBuilder chainable construction of a device tree, see Build
+type DeviceBuilder interface {
+	// Node add a node, panics like Device.AddNode if id is invalid or already added
+	Node(id string, nodeType string) NodeBuilder
+	Device() Device
+}
+
+// NodeBuilder chainable construction of a node
+type NodeBuilder interface {
+	// Name set node $name
+	Name(name string) NodeBuilder
+	// Property add a property without datatype
+	Property(id string) PropertyBuilder
+	// Done returns the device builder
+	Done() DeviceBuilder
+	Node() Node
+	Device() Device
+}
+
+// PropertyBuilder chainable construction of a property
+type PropertyBuilder interface {
+	Name(name string) PropertyBuilder
+	Datatype(dt Datatype) PropertyBuilder
+	Format(format string) PropertyBuilder
+	Unit(unit string) PropertyBuilder
+	Retained(retained bool) PropertyBuilder
+	// Value set initial value
+	Value(value string) PropertyBuilder
+	// Settable accept any valid value received on /set if true, remove the handler if false
+	Settable(settable bool) PropertyBuilder
+	// OnSet make property settable with handler, see Property.OnSet
+	OnSet(handler func(value string) error) PropertyBuilder
+	// Done returns the node builder
+	Done() NodeBuilder
+	Property() Property
+}
+
+type deviceBuilder struct {
+	device Device
+}
+
+type nodeBuilder struct {
+	parent *deviceBuilder
+	node   Node
+}
+
+type propertyBuilder struct {
+	parent   *nodeBuilder
+	property Property
+}
+
+// Build start building a device, e.g.
+// Build("thermostat", cfg).Node("heater", "Heater").Property("target").Datatype(Float).Unit("°C").Done().Done().Device()
+func Build(name string, cfg *Config) DeviceBuilder {
+	return &deviceBuilder{device: NewDevice(name, cfg)}
+}
+
+func (b *deviceBuilder) Node(id string, nodeType string) NodeBuilder {
+	return &nodeBuilder{parent: b, node: b.device.NewNode(id, nodeType)}
+}
+
+func (b *deviceBuilder) Device() Device {
+	return b.device
+}
+
+func (b *nodeBuilder) Name(name string) NodeBuilder {
+	b.node.SetName(name)
+	return b
+}
+
+func (b *nodeBuilder) Property(id string) PropertyBuilder {
+	return &propertyBuilder{parent: b, property: b.node.NewProperty(id, "")}
+}
+
+func (b *nodeBuilder) Done() DeviceBuilder {
+	return b.parent
+}
+
+func (b *nodeBuilder) Node() Node {
+	return b.node
+}
+
+func (b *nodeBuilder) Device() Device {
+	return b.parent.device
+}
+
+func (b *propertyBuilder) Name(name string) PropertyBuilder {
+	b.property.SetName(name)
+	return b
+}
+
+func (b *propertyBuilder) Datatype(dt Datatype) PropertyBuilder {
+	b.property.SetDatatype(dt)
+	return b
+}
+
+func (b *propertyBuilder) Format(format string) PropertyBuilder {
+	b.property.SetFormat(format)
+	return b
+}
+
+func (b *propertyBuilder) Unit(unit string) PropertyBuilder {
+	b.property.SetUnit(unit)
+	return b
+}
+
+func (b *propertyBuilder) Retained(retained bool) PropertyBuilder {
+	b.property.SetRetained(retained)
+	return b
+}
+
+func (b *propertyBuilder) Value(value string) PropertyBuilder {
+	b.property.SetValue(value)
+	return b
+}
+
+func (b *propertyBuilder) Settable(settable bool) PropertyBuilder {
+	if !settable {
+		b.property.SetHandler(nil)
+	}
+	b.property.SetSettable(settable)
+	return b
+}
+
+func (b *propertyBuilder) OnSet(handler func(value string) error) PropertyBuilder {
+	b.property.OnSet(handler)
+	return b
+}
+
+func (b *propertyBuilder) Done() NodeBuilder {
+	return b.parent
+}
+
+func (b *propertyBuilder) Property() Property {
+	return b.property
+}
@@ -0,0 +1,51 @@
+package homie
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type collector struct {
+	devices    []Device
+	connected  *prometheus.Desc
+	reconnects *prometheus.Desc
+	published  *prometheus.Desc
+	uptime     *prometheus.Desc
+}
+
+// NewCollector create a prometheus collector exposing connection state, reconnect count, published messages
+// and uptime of devices, labeled by device name
+func NewCollector(devices ...Device) prometheus.Collector {
+	labels := []string{"device"}
+	return &collector{
+		devices:    devices,
+		connected:  prometheus.NewDesc("homie_device_connected", "Whether the device is connected to the broker.", labels, nil),
+		reconnects: prometheus.NewDesc("homie_device_reconnects_total", "Number of lost broker connections.", labels, nil),
+		published:  prometheus.NewDesc("homie_device_messages_published_total", "Number of published messages.", labels, nil),
+		uptime:     prometheus.NewDesc("homie_device_uptime_seconds", "Time since device startup.", labels, nil),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.connected
+	ch <- c.reconnects
+	ch <- c.published
+	ch <- c.uptime
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range c.devices {
+		connected := 0.0
+		if d.IsConnected() {
+			connected = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.connected, prometheus.GaugeValue, connected, d.Name())
+		ch <- prometheus.MustNewConstMetric(c.reconnects, prometheus.CounterValue, float64(d.Stats().ReconnectCount()), d.Name())
+		if stats, ok := d.Stats().(*deviceStats); ok {
+			ch <- prometheus.MustNewConstMetric(c.published, prometheus.CounterValue, float64(atomic.LoadUint64(&stats.published)), d.Name())
+		}
+		ch <- prometheus.MustNewConstMetric(c.uptime, prometheus.GaugeValue, time.Since(d.Stats().StartupTime()).Seconds(), d.Name())
+	}
+}
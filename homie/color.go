@@ -0,0 +1,43 @@
+package homie
+
+import (
+	"fmt"
+)
+
+// RGB color of a color property with rgb $format
+type RGB struct {
+	R, G, B uint8
+}
+
+// String returns the Homie payload, e.g. 255,128,0
+func (c RGB) String() string {
+	return fmt.Sprintf("%d,%d,%d", c.R, c.G, c.B)
+}
+
+// HSV color of a color property with hsv $format, hue 0-360, saturation and value 0-100
+type HSV struct {
+	H, S, V int
+}
+
+// String returns the Homie payload, e.g. 120,50,100
+func (c HSV) String() string {
+	return fmt.Sprintf("%d,%d,%d", c.H, c.S, c.V)
+}
+
+// ParseRGB parse an rgb color payload, returns an error if a component is out of 0-255
+func ParseRGB(value string) (RGB, error) {
+	if err := Color.ValidateFormat("rgb", value); err != nil {
+		return RGB{}, err
+	}
+	c, _ := parseColor(value)
+	return RGB{R: uint8(c[0]), G: uint8(c[1]), B: uint8(c[2])}, nil
+}
+
+// ParseHSV parse an hsv color payload, returns an error if a component is out of range
+func ParseHSV(value string) (HSV, error) {
+	if err := Color.ValidateFormat("hsv", value); err != nil {
+		return HSV{}, err
+	}
+	c, _ := parseColor(value)
+	return HSV{H: c[0], S: c[1], V: c[2]}, nil
+}
@@ -1,18 +1,382 @@
 package homie
 
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
 // MqttConfig broker config
 type MqttConfig struct {
-	URL              string
-	Username         string
-	Password         string
-	OnConnect        func(device Device)
-	OnConnectionLost func(device Device, err error)
-	OnBroadcast      func(device Device, level string, message []byte)
+	URL              string                                            `json:"url" yaml:"url"`
+	URLs             []string                                          `json:"urls" yaml:"urls"`           // optional, failover brokers tried in order after URL
+	ClientID         string                                            `json:"client_id" yaml:"client_id"` // optional, defaults to the device name or controller id
+	Username         string                                            `json:"username" yaml:"username"`
+	Password         string                                            `json:"password" yaml:"password"`
+	OnConnect        func(device Device)                               `json:"-" yaml:"-"`
+	OnConnectionLost func(device Device, err error)                    `json:"-" yaml:"-"`
+	OnWake           func(device Device)                               `json:"-" yaml:"-"` // called after OnConnect if the device was sleeping
+	OnBroadcast      func(device Device, level string, message []byte) `json:"-" yaml:"-"`
+	ClientFactory    MqttClientFactory                                 `json:"-" yaml:"-"` // optional, defaults to paho mqtt.NewClient
+
+	KeepAlive            time.Duration `json:"keep_alive" yaml:"keep_alive"`                         // optional, defaults to 30s
+	CleanSession         *bool         `json:"clean_session" yaml:"clean_session"`                   // optional, defaults to true
+	MaxReconnectInterval time.Duration `json:"max_reconnect_interval" yaml:"max_reconnect_interval"` // optional, defaults to 10m
+	AutoReconnect        *bool         `json:"auto_reconnect" yaml:"auto_reconnect"`                 // optional, defaults to true
+	Quiesce              time.Duration `json:"quiesce" yaml:"quiesce"`                               // optional, max wait for pending work on disconnect, defaults to 500ms
+	// ProtocolVersion optional, 3 for MQTT 3.1, 4 for MQTT 3.1.1 or 5 for MQTT 5, defaults to 3.1.1 with fallback to 3.1,
+	// MQTT 5 requires a ClientFactory creating an MqttV5Adapter as the paho client does not support it
+	ProtocolVersion uint `json:"protocol_version" yaml:"protocol_version"`
+	// RandomizeClientID optional, append a random suffix to the client id on each connect to avoid collisions
+	RandomizeClientID bool `json:"randomize_client_id" yaml:"randomize_client_id"`
+
+	Will *WillOptions `json:"will" yaml:"will"` // optional, replaces the default will publishing $state lost
+	// ReconnectBackoff optional, devices reconnect themselves with exponential backoff instead of paho auto reconnect
+	ReconnectBackoff *BackoffOptions `json:"reconnect_backoff" yaml:"reconnect_backoff"`
+
+	TLS *TLSOptions `json:"tls" yaml:"tls"` // optional, custom CA and client certificate
+	// TLSConfig optional, used as is when set, TLS and the broker URL host are ignored
+	TLSConfig *tls.Config `json:"-" yaml:"-"`
+}
+
+// brokers returns URL followed by URLs, without empty and duplicate URLs, URL if none is set
+func (c *MqttConfig) brokers() []string {
+	var brokers []string
+	seen := make(map[string]bool)
+	for _, broker := range append([]string{c.URL}, c.URLs...) {
+		if broker != "" && !seen[broker] {
+			seen[broker] = true
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return []string{c.URL}
+	}
+	return brokers
+}
+
+// clientID returns ClientID or defaultID if not set, with a random suffix if RandomizeClientID is set
+func (c *MqttConfig) clientID(defaultID string) string {
+	id := c.ClientID
+	if id == "" {
+		id = defaultID
+	}
+	if c.RandomizeClientID {
+		id = fmt.Sprintf("%s-%s", id, randomSuffix())
+	}
+	return id
+}
+
+// randomSuffix returns 8 hex digits from crypto/rand, the math/rand global source is not seeded before Go 1.20
+func randomSuffix() string {
+	var b [4]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%08x", uint32(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (c *MqttConfig) quiesce() time.Duration {
+	if c.Quiesce <= 0 {
+		return 500 * time.Millisecond
+	}
+	return c.Quiesce
+}
+
+// WillOptions last will message sent by the broker when the connection is lost, MQTT allows a single will per client
+type WillOptions struct {
+	Topic    string `json:"topic" yaml:"topic"` // absolute topic, not prefixed with BaseTopic
+	Payload  string `json:"payload" yaml:"payload"`
+	QoS      byte   `json:"qos" yaml:"qos"`
+	Retained bool   `json:"retained" yaml:"retained"`
+}
+
+// BackoffOptions reconnect delays, doubled after each failed attempt from Min up to Max
+type BackoffOptions struct {
+	Min    time.Duration `json:"min" yaml:"min"`       // defaults to 1s
+	Max    time.Duration `json:"max" yaml:"max"`       // defaults to MqttConfig MaxReconnectInterval or 10m
+	Jitter float64       `json:"jitter" yaml:"jitter"` // optional, randomize delays by +/- Jitter fraction, e.g. 0.2
+}
+
+// jitterRand seeded source of reconnect jitter, the math/rand global source is not seeded before Go 1.20
+var (
+	jitterMutex sync.Mutex
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// delay returns wait time before reconnect attempt (starting at 0), never above max
+func (b *BackoffOptions) delay(attempt int, max time.Duration) time.Duration {
+	min := b.Min
+	if min <= 0 {
+		min = time.Second
+	}
+	if b.Max > 0 {
+		max = b.Max
+	}
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if b.Jitter > 0 {
+		jitterMutex.Lock()
+		factor := jitterRand.Float64()*2 - 1
+		jitterMutex.Unlock()
+		delay += time.Duration(factor * b.Jitter * float64(delay))
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// TLSOptions TLS files of broker connection, CertFile and KeyFile must be set together
+type TLSOptions struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`     // PEM encoded CA certificates, added to RootCAs
+	CertFile           string `json:"cert_file" yaml:"cert_file"` // PEM encoded client certificate
+	KeyFile            string `json:"key_file" yaml:"key_file"`   // PEM encoded client key
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
 }
 
 // Config homie config
 type Config struct {
-	Mqtt                MqttConfig
-	BaseTopic           string // must end with '/'
-	StatsReportInterval int    // in seconds
+	Mqtt                MqttConfig `json:"mqtt" yaml:"mqtt"`
+	BaseTopic           string     `json:"base_topic" yaml:"base_topic"`                       // must end with '/', see Validate
+	StatsReportInterval int        `json:"stats_report_interval" yaml:"stats_report_interval"` // in seconds
+	FirmwareName        string     `json:"firmware_name" yaml:"firmware_name"`                 // optional, published as $fw/name
+	FirmwareVersion     string     `json:"firmware_version" yaml:"firmware_version"`           // optional, published as $fw/version
+	QoS                 *byte      `json:"qos" yaml:"qos"`                                     // optional, QoS of publishes, subscriptions and will message, defaults to 1
+	Extensions          []string   `json:"extensions" yaml:"extensions"`                       // optional, supported extension ids, published as $extensions
+	Implementation      string     `json:"implementation" yaml:"implementation"`               // optional, published as $implementation, defaults to homie-go
+	PublishConcurrency  int        `json:"publish_concurrency" yaml:"publish_concurrency"`     // optional, number of nodes published in parallel on connect, defaults to 1
+	BroadcastTopic      string     `json:"broadcast_topic" yaml:"broadcast_topic"`             // optional, broadcast topic relative to BaseTopic, defaults to $broadcast
+	LocalIP             string     `json:"local_ip" yaml:"local_ip"`                           // optional, published as $localip, defaults to the outbound interface IP
+	StateQoS            *byte      `json:"state_qos" yaml:"state_qos"`                         // optional, QoS of $state and the default will, defaults to QoS
+	StateRetained       *bool      `json:"state_retained" yaml:"state_retained"`               // optional, retain flag of $state and the default will, defaults to true
+	DryRun              bool       `json:"dry_run" yaml:"dry_run"`                             // optional, log publishes with Logger instead of connecting to the broker
+	LazyMetadata        bool       `json:"lazy_metadata" yaml:"lazy_metadata"`                 // optional, publish node attributes when a node first publishes a value
+	SpecVersion         string     `json:"spec_version" yaml:"spec_version"`                   // optional, published as $homie, defaults to HomieSpecVersion, see Validate
+	Logger              Logger     `json:"-" yaml:"-"`                                         // optional, defaults to a no-op logger
+
+	// PublishInterceptor optional, called before each publish with a non empty payload and returning the payload
+	// sent instead, e.g. to sign or encrypt it, topics and retain flags are not changed so the Homie tree is kept
+	PublishInterceptor func(topic string, payload []byte) []byte `json:"-" yaml:"-"`
+	// OnPublished optional, called with the sent payload once the broker received it or the publish failed
+	OnPublished func(topic string, payload []byte, err error) `json:"-" yaml:"-"`
+	// OnSubscribeError optional, called when a subscription made by the device fails or is refused by the broker,
+	// e.g. denied by an ACL, failures are also logged
+	OnSubscribeError func(topic string, err error) `json:"-" yaml:"-"`
+	// OperationTimeout optional, max wait for connect, publish, subscribe and disconnect tokens, defaults to no limit
+	// for connect, publish and subscribe and to Mqtt.Quiesce for disconnect
+	OperationTimeout time.Duration `json:"operation_timeout" yaml:"operation_timeout"`
+}
+
+// clone returns a copy of the config not sharing slices and options with c, callbacks and Logger are shared
+func (c *Config) clone() *Config {
+	cfg := *c
+	cfg.Extensions = append([]string(nil), c.Extensions...)
+	cfg.Mqtt.URLs = append([]string(nil), c.Mqtt.URLs...)
+	if c.Mqtt.Will != nil {
+		will := *c.Mqtt.Will
+		cfg.Mqtt.Will = &will
+	}
+	if c.Mqtt.ReconnectBackoff != nil {
+		backoff := *c.Mqtt.ReconnectBackoff
+		cfg.Mqtt.ReconnectBackoff = &backoff
+	}
+	if c.Mqtt.TLS != nil {
+		tlsOptions := *c.Mqtt.TLS
+		cfg.Mqtt.TLS = &tlsOptions
+	}
+	if c.Mqtt.TLSConfig != nil {
+		cfg.Mqtt.TLSConfig = c.Mqtt.TLSConfig.Clone()
+	}
+	return &cfg
+}
+
+func (c *Config) logger() Logger {
+	if c.Logger == nil {
+		return noopLogger{}
+	}
+	return c.Logger
+}
+
+func (c *Config) implementation() string {
+	if c.Implementation == "" {
+		return "homie-go"
+	}
+	return c.Implementation
+}
+
+func (c *Config) broadcastTopic() string {
+	if c.BroadcastTopic == "" {
+		return "$broadcast"
+	}
+	return c.BroadcastTopic
+}
+
+func (c *Config) qos() byte {
+	if c.QoS == nil {
+		return 1
+	}
+	return *c.QoS
+}
+
+func (c *Config) stateQoS() byte {
+	if c.StateQoS == nil {
+		return c.qos()
+	}
+	return *c.StateQoS
+}
+
+func (c *Config) stateRetained() bool {
+	return c.StateRetained == nil || *c.StateRetained
+}
+
+// disconnectTimeout returns max wait for messages published before disconnecting, OperationTimeout or Mqtt.Quiesce
+func (c *Config) disconnectTimeout() time.Duration {
+	if c.OperationTimeout > 0 {
+		return c.OperationTimeout
+	}
+	return c.Mqtt.quiesce()
+}
+
+func (c *Config) specVersion() string {
+	if c.SpecVersion == "" {
+		return HomieSpecVersion
+	}
+	return c.SpecVersion
+}
+
+// legacySpec returns true for Homie 2.x, the 3.0 tree is published with the 2.x attributes added: $online next to
+// $state, also used as will instead of $state lost, and :settable suffixes in $properties
+func (c *Config) legacySpec() bool {
+	return strings.HasPrefix(c.specVersion(), "2.")
+}
+
+// Validate returns an error if BaseTopic is empty or does not end with '/', if Mqtt.URL or Mqtt.URLs can not be
+// parsed, or if SpecVersion is not a 2.x or 3.x version
+func (c *Config) Validate() error {
+	if c.BaseTopic == "" {
+		return errors.New("BaseTopic is empty")
+	}
+	if !strings.HasSuffix(c.BaseTopic, "/") {
+		return fmt.Errorf("BaseTopic must end with '/': %q", c.BaseTopic)
+	}
+	for _, broker := range append([]string{c.Mqtt.URL}, c.Mqtt.URLs...) {
+		if _, err := url.Parse(broker); err != nil {
+			return fmt.Errorf("invalid MQTT URL: %v", err)
+		}
+	}
+	if v := c.specVersion(); !strings.HasPrefix(v, "2.") && !strings.HasPrefix(v, "3.") {
+		return fmt.Errorf("unsupported Homie spec version: %q", v)
+	}
+	return nil
+}
+
+// LoadConfig read config from a JSON (.json) or YAML (.yaml, .yml) file, callbacks are left unset. Both formats
+// reject unknown fields and accept durations as strings like "1m" or as nanoseconds, the config is validated
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can not read config file %s: %v", path, err)
+	}
+	cfg := &Config{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		data, err = jsonToYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		err = yaml.UnmarshalStrict(data, cfg)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported config file extension: %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// jsonToYAML convert a JSON document to YAML, decoded like YAML files for strict fields and durations
+func jsonToYAML(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after top-level JSON value")
+	}
+	return yaml.Marshal(yamlNumbers(value))
+}
+
+// yamlNumbers replace json.Number values, marshalled as strings by yaml, with integers or floats
+func yamlNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = yamlNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlNumbers(item)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// ConfigFromEnv read config from <prefix>_MQTT_URL, <prefix>_MQTT_USERNAME, <prefix>_MQTT_PASSWORD,
+// <prefix>_BASE_TOPIC (defaults to homie/) and <prefix>_STATS_INTERVAL (in seconds, defaults to 60)
+func ConfigFromEnv(prefix string) (*Config, error) {
+	cfg := &Config{
+		Mqtt: MqttConfig{
+			URL:      os.Getenv(prefix + "_MQTT_URL"),
+			Username: os.Getenv(prefix + "_MQTT_USERNAME"),
+			Password: os.Getenv(prefix + "_MQTT_PASSWORD"),
+		},
+		BaseTopic:           "homie/",
+		StatsReportInterval: 60,
+	}
+	if baseTopic, found := os.LookupEnv(prefix + "_BASE_TOPIC"); found {
+		cfg.BaseTopic = baseTopic
+	}
+	if interval, found := os.LookupEnv(prefix + "_STATS_INTERVAL"); found {
+		seconds, err := strconv.Atoi(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_STATS_INTERVAL: %q", prefix, interval)
+		}
+		cfg.StatsReportInterval = seconds
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
@@ -0,0 +1,353 @@
+package homie
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Controller discovers homie devices published under Config.BaseTopic and keeps a read-only model of them
+type Controller interface {
+	// Devices returns a copy of discovered devices, sorted by id
+	Devices() []DiscoveredDevice
+	// OnDeviceDiscovered set callback invoked when a device $homie attribute is received for the first time
+	OnDeviceDiscovered(handler func(device DiscoveredDevice)) Controller
+	// Refresh collect a fresh snapshot of a device from its retained messages, e.g. after a controller restart, the
+	// device does not need to be discovered, returns an error if no retained message is received
+	Refresh(deviceID string) (DeviceSnapshot, error)
+	Connect() error
+	ConnectContext(ctx context.Context) error
+	Disconnect() error
+}
+
+// DeviceSnapshot a device collected by Controller.Refresh
+type DeviceSnapshot = DiscoveredDevice
+
+// refreshWindow time Refresh waits for retained messages after subscribing
+var refreshWindow = 250 * time.Millisecond
+
+// DiscoveredDevice a snapshot of a discovered device, attributes are keyed without device prefix, e.g. $name or $stats/uptime
+type DiscoveredDevice struct {
+	ID         string
+	Attributes map[string]string
+	Nodes      map[string]DiscoveredNode
+}
+
+// DiscoveredNode a snapshot of a discovered node, attributes are keyed like $name or $type
+type DiscoveredNode struct {
+	ID         string
+	Attributes map[string]string
+	Properties map[string]DiscoveredProperty
+}
+
+// DiscoveredProperty a snapshot of a discovered property, attributes are keyed like $datatype or $unit
+type DiscoveredProperty struct {
+	ID         string
+	Value      string
+	Attributes map[string]string
+}
+
+// State returns device $state, "lost" means the device has disappeared
+func (d DiscoveredDevice) State() string {
+	return d.Attributes["$state"]
+}
+
+// Name returns device $name
+func (d DiscoveredDevice) Name() string {
+	return d.Attributes["$name"]
+}
+
+type controller struct {
+	clientID     string
+	config       *Config
+	client       MqttAdapter
+	devices      map[string]*DiscoveredDevice
+	onDiscovered func(device DiscoveredDevice)
+	mutex        *sync.Mutex
+}
+
+// NewController create a controller, clientID is used as MQTT client id
+func NewController(clientID string, cfg *Config) Controller {
+	return &controller{
+		clientID: clientID,
+		config:   cfg,
+		devices:  make(map[string]*DiscoveredDevice),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (c *controller) Devices() []DiscoveredDevice {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	devices := make([]DiscoveredDevice, 0, len(c.devices))
+	for _, d := range c.devices {
+		devices = append(devices, d.copy())
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].ID < devices[j].ID
+	})
+	return devices
+}
+
+func (c *controller) OnDeviceDiscovered(handler func(device DiscoveredDevice)) Controller {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onDiscovered = handler
+	return c
+}
+
+func (c *controller) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+func (c *controller) ConnectContext(ctx context.Context) error {
+	if err := c.config.Validate(); err != nil {
+		return err
+	}
+	opts, err := newClientOptions(c.clientID, &c.config.Mqtt)
+	if err != nil {
+		return err
+	}
+	var client MqttAdapter
+	opts.SetOnConnectHandler(func(_ mqtt.Client) {
+		if c.getClient() != client {
+			c.config.logger().Warnf("Controller %s ignored connection of an aborted connect", c.clientID)
+			return
+		}
+		c.config.logger().Infof("Controller %s connected", c.clientID)
+		c.subscribe()
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		c.config.logger().Warnf("Controller %s connection lost: %v", c.clientID, err)
+	})
+	client = newMqttClient(&c.config.Mqtt, opts)
+	c.mutex.Lock()
+	c.client = client
+	c.mutex.Unlock()
+	token := client.Connect()
+	if err := waitTokenTimeout(ctx, token, c.config.OperationTimeout); err != nil {
+		// a late OnConnect is ignored
+		c.mutex.Lock()
+		c.client = nil
+		c.mutex.Unlock()
+		closeAborted(client, token)
+		return err
+	}
+	return nil
+}
+
+func (c *controller) getClient() MqttAdapter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.client
+}
+
+func (c *controller) Disconnect() error {
+	client := c.getClient()
+	if client == nil {
+		return ErrNotConnected
+	}
+	client.Disconnect(uint(c.config.Mqtt.quiesce() / time.Millisecond))
+	return nil
+}
+
+func (c *controller) Refresh(deviceID string) (DeviceSnapshot, error) {
+	client := c.getClient()
+	if client == nil {
+		return DeviceSnapshot{}, fmt.Errorf("controller %s can not refresh %s: %w", c.clientID, deviceID, ErrNotConnected)
+	}
+	var mutex sync.Mutex
+	snapshot := newDiscoveredDevice(deviceID)
+	received := 0
+	done := false
+	prefix := c.config.BaseTopic + deviceID + "/"
+	topic := prefix + "#"
+	token := client.Subscribe(topic, c.config.qos(), func(_ mqtt.Client, message mqtt.Message) {
+		if !message.Retained() {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if done {
+			return
+		}
+		received++
+		snapshot.update(strings.Split(strings.TrimPrefix(message.Topic(), prefix), "/"), string(message.Payload()))
+	})
+	if err := waitTokenTimeout(context.Background(), token, c.config.OperationTimeout); err != nil {
+		return DeviceSnapshot{}, err
+	}
+	time.Sleep(refreshWindow)
+	mutex.Lock()
+	done = true
+	result := snapshot.copy()
+	mutex.Unlock()
+
+	c.mutex.Lock()
+	_, known := c.devices[deviceID]
+	c.mutex.Unlock()
+	if known {
+		// the filter is shared with the device subscription of the model, restore its handler
+		c.subscribeDevice(deviceID)
+	} else if unsubscriber, ok := client.(MqttUnsubscriber); ok {
+		unsubscriber.Unsubscribe(topic)
+	}
+	if received == 0 {
+		return DeviceSnapshot{}, fmt.Errorf("no retained messages received for device %s", deviceID)
+	}
+	return result, nil
+}
+
+func (c *controller) subscribe() {
+	c.getClient().Subscribe(c.config.BaseTopic+"+/$homie", c.config.qos(), func(_ mqtt.Client, message mqtt.Message) {
+		c.onMessage(message.Topic(), string(message.Payload()))
+	})
+	// re-subscribe trees of already known devices after a reconnect
+	c.mutex.Lock()
+	ids := make([]string, 0, len(c.devices))
+	for id := range c.devices {
+		ids = append(ids, id)
+	}
+	c.mutex.Unlock()
+	for _, id := range ids {
+		c.subscribeDevice(id)
+	}
+}
+
+func (c *controller) subscribeDevice(id string) {
+	c.getClient().Subscribe(fmt.Sprintf("%s%s/#", c.config.BaseTopic, id), c.config.qos(), func(_ mqtt.Client, message mqtt.Message) {
+		c.onMessage(message.Topic(), string(message.Payload()))
+	})
+}
+
+// onMessage update model from a message, an empty payload clears the retained value
+func (c *controller) onMessage(topic string, payload string) {
+	parts := strings.Split(strings.TrimPrefix(topic, c.config.BaseTopic), "/")
+	if len(parts) < 2 {
+		return
+	}
+	c.mutex.Lock()
+	id := parts[0]
+	d, known := c.devices[id]
+	if parts[1] == "$homie" {
+		if payload == "" {
+			delete(c.devices, id)
+			c.mutex.Unlock()
+			return
+		}
+		if !known {
+			d = newDiscoveredDevice(id)
+			c.devices[id] = d
+		}
+	}
+	if d == nil {
+		// messages of undiscovered devices are ignored until $homie arrives
+		c.mutex.Unlock()
+		return
+	}
+	d.update(parts[1:], payload)
+	discovered := !known
+	snapshot := d.copy()
+	handler := c.onDiscovered
+	c.mutex.Unlock()
+
+	if discovered {
+		c.config.logger().Debugf("Controller %s discovered device %s", c.clientID, id)
+		c.subscribeDevice(id)
+		if handler != nil {
+			handler(snapshot)
+		}
+	}
+}
+
+func newDiscoveredDevice(id string) *DiscoveredDevice {
+	return &DiscoveredDevice{
+		ID:         id,
+		Attributes: make(map[string]string),
+		Nodes:      make(map[string]DiscoveredNode),
+	}
+}
+
+// update apply a message with topic parts relative to the device, nodes and properties are created on demand
+// as retained messages may arrive in any order
+func (d *DiscoveredDevice) update(parts []string, payload string) {
+	if strings.HasPrefix(parts[0], "$") {
+		setAttribute(d.Attributes, strings.Join(parts, "/"), payload)
+		return
+	}
+	if len(parts) < 2 {
+		return
+	}
+	n, found := d.Nodes[parts[0]]
+	if !found {
+		n = DiscoveredNode{
+			ID:         parts[0],
+			Attributes: make(map[string]string),
+			Properties: make(map[string]DiscoveredProperty),
+		}
+	}
+	defer func() { d.Nodes[n.ID] = n }()
+	if strings.HasPrefix(parts[1], "$") {
+		setAttribute(n.Attributes, strings.Join(parts[1:], "/"), payload)
+		return
+	}
+	p, found := n.Properties[parts[1]]
+	if !found {
+		p = DiscoveredProperty{
+			ID:         parts[1],
+			Attributes: make(map[string]string),
+		}
+	}
+	switch {
+	case len(parts) == 2:
+		p.Value = payload
+	case parts[2] == "set":
+		// commands sent to the device are not part of the model
+	default:
+		setAttribute(p.Attributes, strings.Join(parts[2:], "/"), payload)
+	}
+	n.Properties[p.ID] = p
+}
+
+func setAttribute(attributes map[string]string, key string, value string) {
+	if value == "" {
+		delete(attributes, key)
+		return
+	}
+	attributes[key] = value
+}
+
+func (d *DiscoveredDevice) copy() DiscoveredDevice {
+	result := *newDiscoveredDevice(d.ID)
+	for k, v := range d.Attributes {
+		result.Attributes[k] = v
+	}
+	for id, n := range d.Nodes {
+		node := DiscoveredNode{
+			ID:         id,
+			Attributes: make(map[string]string),
+			Properties: make(map[string]DiscoveredProperty),
+		}
+		for k, v := range n.Attributes {
+			node.Attributes[k] = v
+		}
+		for pid, p := range n.Properties {
+			prop := DiscoveredProperty{
+				ID:         pid,
+				Value:      p.Value,
+				Attributes: make(map[string]string),
+			}
+			for k, v := range p.Attributes {
+				prop.Attributes[k] = v
+			}
+			node.Properties[pid] = prop
+		}
+		result.Nodes[id] = node
+	}
+	return result
+}
@@ -0,0 +1,128 @@
+package homie
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Datatype homie property $datatype
+type Datatype string
+
+// Homie property datatypes
+const (
+	Integer Datatype = "integer"
+	Float   Datatype = "float"
+	Boolean Datatype = "boolean"
+	String  Datatype = "string"
+	Enum    Datatype = "enum"
+	Color   Datatype = "color"
+)
+
+// Validate returns an error if value is not a valid payload for the datatype, unknown datatypes accept any value
+func (dt Datatype) Validate(value string) error {
+	switch dt {
+	case Integer:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("invalid integer value: %q", value)
+		}
+	case Float:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("invalid float value: %q", value)
+		}
+	case Boolean:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("invalid boolean value: %q", value)
+		}
+	case Enum:
+		if value == "" {
+			return fmt.Errorf("invalid enum value: %q", value)
+		}
+	case Color:
+		if _, err := parseColor(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseColor parse a color payload with three comma separated components, e.g. 255,128,0
+func parseColor(value string) ([3]int, error) {
+	var components [3]int
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return components, fmt.Errorf("invalid color value: %q", value)
+	}
+	for i, part := range parts {
+		c, err := strconv.Atoi(part)
+		if err != nil || c < 0 {
+			return components, fmt.Errorf("invalid color value: %q", value)
+		}
+		components[i] = c
+	}
+	return components, nil
+}
+
+// ValidateFormat validate value against the datatype and a $format, e.g. 10:15 for integer and float ranges (inclusive),
+// on,off,pause for enum and rgb or hsv for color. Formats of other datatypes are not checked, an empty format only
+// validates the datatype
+func (dt Datatype) ValidateFormat(format string, value string) error {
+	if err := dt.Validate(value); err != nil {
+		return err
+	}
+	if format == "" {
+		return nil
+	}
+	switch dt {
+	case Integer, Float:
+		min, max, err := parseRange(format)
+		if err != nil {
+			return err
+		}
+		v, _ := strconv.ParseFloat(value, 64)
+		if v < min || v > max {
+			return fmt.Errorf("value %s is out of range %s", value, format)
+		}
+	case Enum:
+		for _, option := range strings.Split(format, ",") {
+			if option == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("value %s is not one of %s", value, format)
+	case Color:
+		components, _ := parseColor(value)
+		var max [3]int
+		switch format {
+		case "rgb":
+			max = [3]int{255, 255, 255}
+		case "hsv":
+			max = [3]int{360, 100, 100}
+		default:
+			return fmt.Errorf("invalid color format: %q", format)
+		}
+		for i, c := range components {
+			if c > max[i] {
+				return fmt.Errorf("value %s is out of range for %s", value, format)
+			}
+		}
+	}
+	return nil
+}
+
+// parseRange parse a from:to range format
+func parseRange(format string) (float64, float64, error) {
+	parts := strings.Split(format, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range format: %q", format)
+	}
+	min, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range format: %q", format)
+	}
+	max, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || min > max {
+		return 0, 0, fmt.Errorf("invalid range format: %q", format)
+	}
+	return min, max, nil
+}
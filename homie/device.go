@@ -1,13 +1,15 @@
 package homie
 
 import (
-	"crypto/tls"
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -17,31 +19,162 @@ import (
 type Device interface {
 	Name() string
 	Stats() DeviceStats
+	// NewNode create and add a node, leading and trailing spaces of nodeType are removed
 	NewNode(name string, nodeType string) Node
+	// NewArrayNode create an array node with instances name_0 to name_<length-1>
+	NewArrayNode(name string, nodeType string, length int) Node
+	// AddNode add node to device, panics if a node with same name is already added or the name is not a valid id,
+	// when connected the node is published and $nodes updated
 	AddNode(node Node) Node
+	// AddNodeErr add node to device, returns an error if a node with same name is already added or the name is
+	// not a valid id, see ValidateID
+	AddNodeErr(node Node) (Node, error)
 	GetNode(name string) Node
+	// RemoveNode remove a node, when connected $nodes is updated and retained topics of the node are cleared
+	RemoveNode(name string) error
+	// Nodes returns a copy of device nodes sorted by name
+	Nodes() []Node
+	// NodeTypes returns sorted distinct $type of device nodes
+	NodeTypes() []string
+	// SetMeta set a meta extension key/value pair, published under $meta, add "org.homie.meta" to
+	// Config.Extensions to advertise it
+	SetMeta(key string, value string) Device
+	// Clone returns an unconnected copy of the device named newName, with copies of config, nodes, properties and
+	// their values, handlers and publishers are shared, stats and state start from scratch
+	Clone(newName string) Device
+	// Connect connect to broker, returns an error if device or property ids are not valid, see ValidateID, or if a
+	// node $type is not valid, see ValidateNodeType
 	Connect() error
+	// ConnectContext connect to broker, aborts when ctx is cancelled or its deadline passes
+	ConnectContext(ctx context.Context) error
+	// Run connect and publish stats periodically, blocks forever if block is true
+	//
+	// Deprecated: connect errors are ignored, use RunContext
 	Run(block bool)
+	// RunContext connect and publish stats periodically until ctx is done, then disconnect gracefully
+	RunContext(ctx context.Context) error
 	Config() *Config
 	Client() MqttAdapter
+	// SetClient set the adapter used by the next Connect instead of creating one, the device initialisation runs
+	// once Connect() token completes, use MqttConfig.ClientFactory for adapters reporting lost connections
+	SetClient(client MqttAdapter) Device
+	// ConnectionInfo returns details of the current or last connection, zero before the first connect
+	ConnectionInfo() ConnectionInfo
+	// IsConnected returns true if the client is connected, false before the first connect
+	IsConnected() bool
+	// WaitForConnection block until connected, returns ctx.Err() if ctx is done first
+	WaitForConnection(ctx context.Context) error
 	OnConnect(client MqttAdapter)
 	OnConnectionLost(client MqttAdapter, err error)
+	// AddConnectHandler register a handler called after each connect, after MqttConfig.OnConnect
+	AddConnectHandler(handler func(device Device)) Device
+	// AddConnectionLostHandler register a handler called when connection is lost, after MqttConfig.OnConnectionLost
+	AddConnectionLostHandler(handler func(device Device, err error)) Device
+	// Subscribe subscribe to an absolute topic through the device client, filters may contain + and # wildcards,
+	// subscriptions are restored after each reconnect, subscribing again to a topic replaces its handler
+	Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) error
+	// Unsubscribe end a subscription made with Subscribe, returns an error if topic is not subscribed
+	Unsubscribe(topic string) error
+	// OnBroadcastLevel register a handler called for broadcasts of level ($broadcast/level), after
+	// MqttConfig.OnBroadcast
+	OnBroadcastLevel(level string, handler func(device Device, payload []byte)) Device
 
-	// Topic returns full topic for a part, prefixed with baseTopic and deviceName
+	// Topic returns full topic for a part, prefixed with baseTopic and deviceName, wildcards + and # are removed
+	// from the device name
 	Topic(part string) string
+	// SendMessage publish value to a device relative topic, retained with Config QoS, the message is dropped if
+	// called before Connect, use SendMessageAsync to get the error
 	SendMessage(topic string, value string)
+	// SendMessageAsync publish like SendMessage, the token completes once the broker received the message
+	SendMessageAsync(topic string, value string) PublishToken
+	// SendMessageContext publish like SendMessage and wait until the broker received the message, returns ctx.Err()
+	// if ctx is done first
+	SendMessageContext(ctx context.Context, topic string, value string) error
+	// Publish publish to a device relative topic, prefixed like Topic(part)
+	Publish(part string, opts PublishOptions) mqtt.Token
+	// PublishBroadcast publish a non retained broadcast to <baseTopic>$broadcast/<level>, received by every device
+	// sharing the base topic, including this one
+	PublishBroadcast(level string, payload string) PublishToken
+	// PublishRaw publish to an absolute topic, not prefixed with baseTopic and device name, the token fails if
+	// called before Connect or with ErrWildcardTopic if topic contains + or #
+	PublishRaw(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
 	DevicePublisher() DevicePublisher
+	// SetDevicePublisher set the publisher called during device initialisation, panics if already set
 	SetDevicePublisher(publisher DevicePublisher) Device
+	// AddDevicePublisher add a publisher called during device initialisation after the one set with
+	// SetDevicePublisher, publishers are called in the order they were added
+	AddDevicePublisher(publisher DevicePublisher) Device
 
 	PublishStats()
+	// Heartbeat republish current $state, called with PublishStats every StatsReportInterval while running,
+	// controllers can consider a device stale when $state is not refreshed within two $stats/interval periods,
+	// e.g. when the application hangs but the TCP connection stays open
+	Heartbeat() error
+	// Snapshot returns current value of every retained topic published by the device, keyed by full topic,
+	// topics cleared with an empty payload are not included
+	Snapshot() map[string]string
+	// SetStatsInterval change Config.StatsReportInterval at runtime, $stats/interval is republished if connected and
+	// running stats are rescheduled, stats are stopped if seconds is 0
+	SetStatsInterval(seconds int) Device
+	// SetStatsProvider set provider of stats published by PublishStats
+	SetStatsProvider(provider func() DeviceStatsReport) Device
+
+	// State returns last published $state
+	State() string
 
 	Disconnect() error
+	// Reconnect disconnect and connect again with options from the current Config, e.g. after changing credentials
+	Reconnect() error
+	// Purge clear every retained topic published by the device with an empty retained payload, including $state,
+	// then disconnect, use it before decommissioning a device
+	Purge() error
+	// Sleep publish $state sleeping and disconnect, next connect will invoke MqttConfig.OnWake
+	Sleep() error
+
+	// SetAlert publish $state alert and reason as $alert, if not connected the alert is published on connect
+	SetAlert(reason string) error
+	// ClearAlert clear $alert and restore the state from before the alert
+	ClearAlert() error
+}
+
+// PublishToken tracks delivery of a published message, implemented by paho mqtt.Token
+type PublishToken interface {
+	// Wait block until the publish is complete, returns false on timeout
+	Wait() bool
+	// WaitTimeout block until the publish is complete or timeout, returns false on timeout
+	WaitTimeout(timeout time.Duration) bool
+	Error() error
+}
+
+// PublishOptions payload and flags of Device.Publish, fields are used as is without Config defaults
+type PublishOptions struct {
+	Payload  interface{}
+	QoS      byte
+	Retained bool
+	// Properties optional, only sent when MqttConfig.ProtocolVersion is 5 and the client is an MqttV5Adapter
+	Properties *PublishProperties
 }
 
 // DeviceStats stats about device like startup, connect time, etc
 type DeviceStats interface {
 	StartupTime() time.Time
 	ConnectTime() time.Time
+	// ReconnectCount returns number of lost connections since startup
+	ReconnectCount() uint64
+	// LastDisconnect returns time of last lost connection, zero if connection was never lost
+	LastDisconnect() time.Time
+}
+
+// DeviceStatsReport stats published by PublishStats, nil fields are not published except Uptime
+// which defaults to time since device startup
+type DeviceStatsReport struct {
+	Uptime   *uint64  // $stats/uptime in seconds
+	Signal   *int     // $stats/signal in %
+	Battery  *int     // $stats/battery in %
+	CPUTemp  *float64 // $stats/cputemp in °C
+	CPULoad  *int     // $stats/cpuload in %
+	FreeHeap *uint64  // $stats/freeheap in bytes
+	Voltage  *float64 // $stats/supply in V
 }
 
 type device struct {
@@ -51,19 +184,71 @@ type device struct {
 	stats     *deviceStats
 	publisher DevicePublisher
 	client    MqttAdapter
+	custom    MqttAdapter // set by SetClient
+	state     string
+	alert     string // alert reason, empty if no alert
+	lastState string // state before alert
+	meta      metadata
+
+	publishers []DevicePublisher // added with AddDevicePublisher
+
+	retained       map[string]string // retained topics published with a non empty payload
+	connectionInfo ConnectionInfo
+
+	subscribed             bool // subscriptions are done for the current connection
+	closing                bool // Disconnect was called, stops backoff reconnects
+	alertPublished         bool // $alert is set on the broker, cleared on connect if ClearAlert was called meanwhile
+	connectHandlers        []func(device Device)
+	connectionLostHandlers []func(device Device, err error)
+	broadcastHandlers      map[string][]func(device Device, payload []byte)
+	subscriptions          map[string]subscription // added with Subscribe, restored on connect
+
+	statsProvider func() DeviceStatsReport
+	statsPeriod   time.Duration // overrides Config.StatsReportInterval, used in tests
+	statsDone     chan struct{}
+	statsExited   chan struct{} // closed when the stats goroutine returns
+	intervalsDone chan struct{} // stops property publish intervals
 
 	mutex *sync.Mutex
 }
 
+// subscription topic subscribed with Device.Subscribe
+type subscription struct {
+	qos     byte
+	handler func(topic string, payload []byte)
+}
+
 type deviceStats struct {
+	reconnects  uint64 // connection lost count, updated atomically
+	published   uint64 // published message count, updated atomically
 	startupTime time.Time
 	connectTime time.Time
+
+	lastDisconnect time.Time
+	mutex          sync.Mutex // guards lastDisconnect
 }
 
 func (s *deviceStats) StartupTime() time.Time {
 	return s.startupTime
 }
 
+func (s *deviceStats) ReconnectCount() uint64 {
+	return atomic.LoadUint64(&s.reconnects)
+}
+
+func (s *deviceStats) LastDisconnect() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastDisconnect
+}
+
+func (s *deviceStats) connectionLost() {
+	atomic.AddUint64(&s.reconnects, 1)
+	s.mutex.Lock()
+	s.lastDisconnect = time.Now()
+	s.mutex.Unlock()
+}
+
 func (s *deviceStats) ConnectTime() time.Time {
 	return s.connectTime
 }
@@ -89,109 +274,690 @@ func (d *device) Stats() DeviceStats {
 }
 
 func (d *device) Client() MqttAdapter {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.client
 }
 
+// setClient replace the client of the current connection, nil once a connect is aborted
+func (d *device) setClient(client MqttAdapter) {
+	d.mutex.Lock()
+	d.client = client
+	d.mutex.Unlock()
+}
+
+func (d *device) SetClient(client MqttAdapter) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.custom = client
+	return d
+}
+
+func (d *device) ConnectionInfo() ConnectionInfo {
+	if provider, ok := d.Client().(ConnectionInfoProvider); ok {
+		info := provider.ConnectionInfo()
+		if info.ConnectedAt.IsZero() {
+			info.ConnectedAt = d.stats.ConnectTime()
+		}
+		return info
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.connectionInfo
+}
+
+// setSessionPresent record session present flag of a completed connect token
+func (d *device) setSessionPresent(token mqtt.Token) {
+	if t, ok := token.(interface{ SessionPresent() bool }); ok {
+		d.mutex.Lock()
+		d.connectionInfo.SessionPresent = t.SessionPresent()
+		d.mutex.Unlock()
+	}
+}
+
+func (d *device) IsConnected() bool {
+	client := d.Client()
+	return client != nil && client.IsConnected()
+}
+
+func (d *device) WaitForConnection(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for !d.IsConnected() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
 func (d *device) Config() *Config {
 	return d.config
 }
 
 func (d *device) GetNode(name string) Node {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	return d.nodes[name]
 }
+func (d *device) RemoveNode(name string) error {
+	d.mutex.Lock()
+	n, found := d.nodes[name]
+	if !found {
+		d.mutex.Unlock()
+		return fmt.Errorf("Node %s not found", name)
+	}
+	delete(d.nodes, name)
+	prefixes := []string{d.Topic(n.NodeTopic(""))}
+	for i := 0; i < n.ArrayLength(); i++ {
+		prefixes = append(prefixes, d.Topic(n.Index(i).NodeTopic("")))
+	}
+	var topics []string
+	for topic := range d.retained {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(topic, prefix) {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	d.mutex.Unlock()
+
+	if !d.IsConnected() {
+		return nil
+	}
+	d.publishNodeList(d.nodeList())
+	sort.Strings(topics)
+	for _, topic := range topics {
+		d.PublishRaw(topic, d.config.qos(), true, "")
+	}
+	return nil
+}
+
+func (d *device) Nodes() []Node {
+	return d.nodeList()
+}
+
+func (d *device) Clone(newName string) Device {
+	c := NewDevice(newName, d.config.clone()).(*device)
+	d.mutex.Lock()
+	c.meta = d.meta.clone()
+	c.publisher = d.publisher
+	c.publishers = append([]DevicePublisher(nil), d.publishers...)
+	c.statsProvider = d.statsProvider
+	c.connectHandlers = append([]func(Device){}, d.connectHandlers...)
+	c.connectionLostHandlers = append([]func(Device, error){}, d.connectionLostHandlers...)
+	for level, handlers := range d.broadcastHandlers {
+		for _, handler := range handlers {
+			c.OnBroadcastLevel(level, handler)
+		}
+	}
+	for topic, s := range d.subscriptions {
+		if c.subscriptions == nil {
+			c.subscriptions = make(map[string]subscription)
+		}
+		c.subscriptions[topic] = s
+	}
+	d.mutex.Unlock()
+	for _, n := range d.nodeList() {
+		if original, ok := n.(*node); ok {
+			c.AddNode(original.clone())
+		} else {
+			d.config.logger().Warnf("Device %s clone: node %s is not copied, unknown implementation", d.name, n.Name())
+		}
+	}
+	return c
+}
+
+func (d *device) NodeTypes() []string {
+	found := make(map[string]bool)
+	var types []string
+	for _, n := range d.nodeList() {
+		if !found[n.Type()] {
+			found[n.Type()] = true
+			types = append(types, n.Type())
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (d *device) SetMeta(key string, value string) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.meta.set(key, value)
+	return d
+}
+
 func (d *device) NewNode(name string, nodeType string) Node {
 	return d.AddNode(&node{
 		name:     name,
-		nodeType: nodeType,
+		nodeType: strings.TrimSpace(nodeType),
 	})
 }
 
+func (d *device) NewArrayNode(name string, nodeType string, length int) Node {
+	return d.AddNode(newArrayNode(name, strings.TrimSpace(nodeType), length))
+}
+
 func (d *device) AddNode(node Node) Node {
-	node.SetDevice(d)
+	node, err := d.AddNodeErr(node)
+	if err != nil {
+		d.config.logger().Errorf("%v", err)
+		log.Panic(err)
+	}
+	return node
+}
+
+func (d *device) AddNodeErr(node Node) (Node, error) {
+	if err := d.addNode(node); err != nil {
+		return nil, err
+	}
+	if d.IsConnected() {
+		d.publishAddedNode(node)
+	}
+	return node, nil
+}
+
+func (d *device) addNode(node Node) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	if d.nodes == nil {
 		d.nodes = make(map[string]Node)
 	}
+	if err := ValidateID(node.Name()); err != nil {
+		return fmt.Errorf("invalid node id: %w", err)
+	}
 	if _, alreadyAdded := d.nodes[node.Name()]; alreadyAdded {
-		log.Panic(fmt.Errorf("Node %s already added", node.Name()))
+		return fmt.Errorf("%w: %s", ErrNodeAlreadyExists, node.Name())
 	}
+	node.SetDevice(d)
 	d.nodes[node.Name()] = node
-	return node
+	return nil
 }
+
+// publishAddedNode subscribe and publish a node added after connect, $nodes is updated once the node is published
+func (d *device) publishAddedNode(n Node) {
+	n.Subscribe()
+	d.publishNodes([]Node{n})
+	d.publishNodeList(d.nodeList())
+	invokeNodePublishers(n)
+}
+
+// validateIDs check device and property ids, node ids are checked by AddNodeErr
+func (d *device) validateIDs() error {
+	if err := ValidateID(d.name); err != nil {
+		return fmt.Errorf("invalid device id: %w", err)
+	}
+	for _, n := range d.nodeList() {
+		if err := ValidateNodeType(n.Type()); err != nil {
+			return fmt.Errorf("invalid $type of node %s: %v", n.Name(), err)
+		}
+		for _, name := range n.PropertyNames() {
+			if err := ValidateID(name); err != nil {
+				return fmt.Errorf("invalid property id of node %s: %w", n.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
 func (d *device) Connect() error {
-	options := d.createMqttOptions()
-	return d.connect(options)
+	return d.ConnectContext(context.Background())
+}
 
+func (d *device) ConnectContext(ctx context.Context) error {
+	if err := d.config.Validate(); err != nil {
+		return err
+	}
+	if err := d.validateIDs(); err != nil {
+		return err
+	}
+	options, err := d.createMqttOptions()
+	if err != nil {
+		return err
+	}
+	d.config.logger().Infof("Device %s connecting to %s", d.name, options.Servers[0]) // without URL credentials
+	if err := d.connect(ctx, options); err != nil {
+		d.config.logger().Errorf("Device %s failed to connect: %v", d.name, err)
+		return err
+	}
+	return nil
 }
 func (d *device) Run(block bool) {
 	d.Connect()
+	d.startStats()
 
 	if block {
 		select {} // block forever
 	}
 }
 
-func (d *device) createMqttOptions() *mqtt.ClientOptions {
-	brokerURL, err := url.Parse(d.config.Mqtt.URL)
+func (d *device) RunContext(ctx context.Context) error {
+	if err := d.ConnectContext(ctx); err != nil {
+		if d.Client() != nil {
+			d.Disconnect()
+		}
+		return err
+	}
+	d.startStats()
+	<-ctx.Done()
+	return d.Disconnect()
+}
+
+func (d *device) createMqttOptions() (*mqtt.ClientOptions, error) {
+	opts, err := newClientOptions(d.name, &d.config.Mqtt)
 	if err != nil {
-		panic(err)
-	}
-	tlsConfig := &tls.Config{
-		ServerName: brokerURL.Hostname(),
-	}
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(d.config.Mqtt.URL)
-	opts.SetUsername(d.config.Mqtt.Username)
-	opts.SetPassword(d.config.Mqtt.Password)
-	opts.SetClientID(d.name)
-	opts.SetBinaryWill(d.Topic("$state"), []byte("lost"), 1, true)
-	opts.SetAutoReconnect(true)
-	opts.SetTLSConfig(tlsConfig)
+		return nil, err
+	}
+	if will := d.config.Mqtt.Will; will != nil {
+		opts.SetBinaryWill(will.Topic, []byte(will.Payload), will.QoS, will.Retained)
+	} else if d.config.legacySpec() {
+		// a single will per client, Homie 2.x controllers only watch $online
+		opts.SetBinaryWill(d.Topic("$online"), []byte("false"), d.config.stateQoS(), d.config.stateRetained())
+	} else {
+		opts.SetBinaryWill(d.Topic("$state"), []byte(StateLost), d.config.stateQoS(), d.config.stateRetained())
+	}
+	if d.config.Mqtt.ReconnectBackoff != nil {
+		opts.SetAutoReconnect(false) // see reconnect
+	}
 	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		d.config.logger().Warnf("Device %s connection lost: %v", d.name, err)
+		d.stats.connectionLost()
+		d.stopIntervals()
+		d.mutex.Lock()
+		d.subscribed = false // broker may drop subscriptions of a clean session
+		d.mutex.Unlock()
 		if d.config != nil && d.config.Mqtt.OnConnectionLost != nil {
 			d.config.Mqtt.OnConnectionLost(d, err)
 		}
-		d.OnConnectionLost(&mqttClientDelegate{
-			client: c,
-		}, err)
+		d.mutex.Lock()
+		handlers := append([]func(Device, error){}, d.connectionLostHandlers...)
+		d.mutex.Unlock()
+		for _, handler := range handlers {
+			handler(d, err)
+		}
+		d.OnConnectionLost(d.Client(), err)
+		if d.config.Mqtt.ReconnectBackoff != nil {
+			go d.reconnect()
+		}
 	})
 	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		// TODO: refactor this, currently it creates multiple instances of delegates on re-connect
-		d.OnConnect(&mqttClientDelegate{
-			client: c,
-		})
+		d.config.logger().Infof("Device %s connected", d.name)
+		info := ConnectionInfo{ClientID: opts.ClientID, ConnectedAt: time.Now()}
+		if len(opts.Servers) == 1 {
+			info.BrokerURL = opts.Servers[0].String()
+		}
+		d.mutex.Lock()
+		info.SessionPresent = d.connectionInfo.SessionPresent // set by connect once the token completes
+		d.connectionInfo = info
+		d.mutex.Unlock()
+		d.OnConnect(d.Client())
 		if d.config != nil && d.config.Mqtt.OnConnect != nil {
 			d.config.Mqtt.OnConnect(d)
 		}
+		d.mutex.Lock()
+		handlers := append([]func(Device){}, d.connectHandlers...)
+		d.mutex.Unlock()
+		for _, handler := range handlers {
+			handler(d)
+		}
 	})
-	return opts
+	return opts, nil
 }
 
 func (d *device) OnConnect(client MqttAdapter) {
+	wasSleeping := d.State() == StateSleeping
+	d.mutex.Lock()
+	if client != d.client {
+		d.subscribed = false
+	}
 	d.client = client
+	d.mutex.Unlock()
 	d.stats.connectTime = time.Now()
+	d.subscribe()
 	d.initNodes()
 	d.initDevice()
+	d.startIntervals()
+	if wasSleeping && d.config.Mqtt.OnWake != nil {
+		d.config.Mqtt.OnWake(d)
+	}
 }
 func (d *device) OnConnectionLost(client MqttAdapter, err error) {
 }
 
-func (d *device) connect(options *mqtt.ClientOptions) error {
-	client := mqtt.NewClient(options)
-	token := client.Connect() // start connecting to broker, initialisation is done in onConnectHandler
-	for !token.WaitTimeout(3 * time.Second) {
+func (d *device) AddConnectHandler(handler func(device Device)) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.connectHandlers = append(d.connectHandlers, handler)
+	return d
+}
+
+func (d *device) AddConnectionLostHandler(handler func(device Device, err error)) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.connectionLostHandlers = append(d.connectionLostHandlers, handler)
+	return d
+}
+
+// reconnect try to connect again after MqttConfig.ReconnectBackoff delays until connected or disconnected
+func (d *device) reconnect() {
+	backoff := d.config.Mqtt.ReconnectBackoff
+	client := d.Client()
+	max := d.config.Mqtt.MaxReconnectInterval
+	if max <= 0 {
+		max = 10 * time.Minute
+	}
+	for attempt := 0; ; attempt++ {
+		delay := backoff.delay(attempt, max)
+		d.config.logger().Infof("Device %s reconnecting in %v", d.name, delay)
+		time.Sleep(delay)
+		d.mutex.Lock()
+		closing := d.closing
+		current := d.client
+		d.mutex.Unlock()
+		if closing || current != client {
+			return // disconnected or replaced by Reconnect
+		}
+		err := waitTokenTimeout(context.Background(), client.Connect(), d.config.OperationTimeout)
+		if err == nil {
+			return
+		}
+		d.config.logger().Warnf("Device %s reconnect failed: %v", d.name, err)
+	}
+}
+
+func (d *device) OnBroadcastLevel(level string, handler func(device Device, payload []byte)) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.broadcastHandlers == nil {
+		d.broadcastHandlers = make(map[string][]func(Device, []byte))
+	}
+	d.broadcastHandlers[level] = append(d.broadcastHandlers[level], handler)
+	return d
+}
+
+func (d *device) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) error {
+	if handler == nil {
+		return errors.New("subscription handler is nil")
+	}
+	d.mutex.Lock()
+	if d.subscriptions == nil {
+		d.subscriptions = make(map[string]subscription)
+	}
+	d.subscriptions[topic] = subscription{qos: qos, handler: handler}
+	d.mutex.Unlock()
+	if !d.IsConnected() {
+		return nil // subscribed on connect
+	}
+	return waitTokenTimeout(context.Background(), d.subscribeTopic(topic, qos), d.config.OperationTimeout)
+}
+
+func (d *device) Unsubscribe(topic string) error {
+	d.mutex.Lock()
+	if _, found := d.subscriptions[topic]; !found {
+		d.mutex.Unlock()
+		return fmt.Errorf("topic %s is not subscribed", topic)
+	}
+	delete(d.subscriptions, topic)
+	d.mutex.Unlock()
+	if !d.IsConnected() {
+		return nil
+	}
+	unsubscriber, ok := d.Client().(MqttUnsubscriber)
+	if !ok {
+		// messages still delivered by the adapter are dropped by subscribeTopic handler
+		d.config.logger().Debugf("Device %s client can not unsubscribe from %s", d.name, topic)
+		return nil
+	}
+	return waitTokenTimeout(context.Background(), unsubscriber.Unsubscribe(topic), d.config.OperationTimeout)
+}
+
+// subscribeTopic subscribe to a topic added with Subscribe, the handler is looked up for each message so it can be
+// replaced or removed without subscribing again
+func (d *device) subscribeTopic(topic string, qos byte) mqtt.Token {
+	return d.Client().Subscribe(topic, qos, func(_ mqtt.Client, message mqtt.Message) {
+		d.mutex.Lock()
+		s, found := d.subscriptions[topic]
+		d.mutex.Unlock()
+		if found {
+			s.handler(message.Topic(), message.Payload())
+		}
+	})
+}
+
+// watchSubscribe log a failed subscription of d and call Config.OnSubscribeError once token completes, a paho
+// subscription refused by the broker completes without error but with a 0x80 return code
+func watchSubscribe(d Device, topic string, token mqtt.Token) {
+	go func() {
+		err := waitTokenTimeout(context.Background(), token, d.Config().OperationTimeout)
+		if subscribeToken, ok := token.(*mqtt.SubscribeToken); ok && err == nil {
+			for _, code := range subscribeToken.Result() {
+				if code == 0x80 {
+					err = errors.New("subscription refused by broker")
+				}
+			}
+		}
+		if err == nil {
+			return
+		}
+		cfg := d.Config()
+		cfg.logger().Errorf("Device %s subscription to %s failed: %v", d.Name(), topic, err)
+		if cfg.OnSubscribeError != nil {
+			cfg.OnSubscribeError(topic, err)
+		}
+	}()
+}
+
+func (d *device) connect(ctx context.Context, options *mqtt.ClientOptions) error {
+	d.mutex.Lock()
+	d.subscribed = false
+	d.closing = false
+	d.connectionInfo.SessionPresent = false
+	custom := d.custom
+	d.mutex.Unlock()
+	var client MqttAdapter
+	onConnect := options.OnConnect
+	options.OnConnect = func(c mqtt.Client) {
+		if d.Client() != client {
+			// connect was aborted or replaced by another connect, abortConnect closes the connection
+			d.config.logger().Warnf("Device %s ignored connection of an aborted connect", d.name)
+			return
+		}
+		onConnect(c)
+	}
+	connectionLost := options.OnConnectionLost
+	options.OnConnectionLost = func(c mqtt.Client, err error) {
+		if d.Client() != client {
+			// client was replaced, e.g. by Reconnect, its state no longer applies to the device
+			d.config.logger().Debugf("Device %s ignored connection lost of a previous client: %v", d.name, err)
+			return
+		}
+		connectionLost(c, err)
+	}
+	if custom != nil && !d.config.DryRun {
+		client = custom
+		// adapter is not aware of options, run initialisation once connected
+		d.setClient(custom)
+		token := custom.Connect()
+		if err := d.waitConnect(ctx, custom, token); err != nil {
+			return err
+		}
+		options.OnConnect(nil)
+		d.setSessionPresent(token)
+		return nil
+	}
+	if d.config.DryRun {
+		client = newDryRunAdapter(options, d.config.logger())
+	} else {
+		client = newMqttClient(&d.config.Mqtt, options)
 	}
-	if err := token.Error(); err != nil {
+	d.setClient(client)
+	token := client.Connect() // start connecting to broker, initialisation is done in onConnectHandler
+	if err := d.waitConnect(ctx, client, token); err != nil {
 		return err
 	}
+	d.setSessionPresent(token)
 	return nil
 }
 
+// waitConnect wait for the connect token, a connection established while the wait gave up is kept, otherwise
+// the connect is aborted
+func (d *device) waitConnect(ctx context.Context, client MqttAdapter, token mqtt.Token) error {
+	err := waitTokenTimeout(ctx, token, d.config.OperationTimeout)
+	if err == nil {
+		return nil
+	}
+	if client.IsConnected() {
+		token.Wait()
+		return token.Error()
+	}
+	d.abortConnect(client, token)
+	return err
+}
+
+// abortConnect drop client of a failed or cancelled connect, a late OnConnect is ignored by the handler
+// installed in connect
+func (d *device) abortConnect(client MqttAdapter, token mqtt.Token) {
+	d.mutex.Lock()
+	if d.client == client {
+		d.client = nil
+	}
+	d.mutex.Unlock()
+	closeAborted(client, token)
+}
+
 func (d *device) Topic(part string) string {
-	return fmt.Sprintf("%s%s/%s", d.config.BaseTopic, d.Name(), part)
+	name, err := escapeTopic(d.Name())
+	if err != nil {
+		d.config.logger().Errorf("Device %s topic: %v", d.name, err)
+	}
+	return fmt.Sprintf("%s%s/%s", d.config.BaseTopic, name, part)
 }
 
 func (d *device) SendMessage(topic string, message string) {
-	d.client.Publish(d.Topic(topic), 1, true, message)
+	d.SendMessageAsync(topic, message)
+}
+
+func (d *device) SendMessageAsync(topic string, message string) PublishToken {
+	return d.Publish(topic, PublishOptions{
+		Payload:  message,
+		QoS:      d.config.qos(),
+		Retained: true,
+	})
+}
+
+func (d *device) SendMessageContext(ctx context.Context, topic string, message string) error {
+	return waitTokenTimeout(ctx, d.SendMessageAsync(topic, message), d.config.OperationTimeout)
+}
+
+func (d *device) Publish(part string, opts PublishOptions) mqtt.Token {
+	return d.publish(d.Topic(part), opts.QoS, opts.Retained, opts.Payload, opts.Properties)
+}
+
+func (d *device) PublishBroadcast(level string, payload string) PublishToken {
+	return d.PublishRaw(d.broadcastTopic(level), d.config.qos(), false, payload)
+}
+
+// broadcastTopic returns absolute topic of a broadcast level
+func (d *device) broadcastTopic(level string) string {
+	return fmt.Sprintf("%s%s/%s", d.config.BaseTopic, d.config.broadcastTopic(), level)
+}
+
+func (d *device) PublishRaw(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return d.publish(topic, qos, retained, payload, nil)
+}
+
+// publish check connection and topic before sending, properties are only sent through an MQTT 5 adapter
+func (d *device) publish(topic string, qos byte, retained bool, payload interface{}, properties *PublishProperties) mqtt.Token {
+	client := d.Client()
+	if client == nil {
+		d.config.logger().Debugf("Device %s not connected, dropped message: %s", d.name, topic)
+		return &errorToken{err: fmt.Errorf("device %s can not publish to %s: %w", d.name, topic, ErrNotConnected)}
+	}
+	if strings.ContainsAny(topic, "+#") {
+		d.config.logger().Errorf("Device %s dropped message: %s: %v", d.name, topic, ErrWildcardTopic)
+		return &errorToken{err: fmt.Errorf("device %s can not publish to %s: %w", d.name, topic, ErrWildcardTopic)}
+	}
+	d.countPublish(topic, retained, payload)
+	payload = d.intercept(topic, payload)
+	if properties != nil && d.config.Mqtt.ProtocolVersion == 5 {
+		if v5, ok := client.(MqttV5Adapter); ok {
+			return d.published(topic, payload, v5.PublishWithProperties(topic, qos, retained, payload, properties))
+		}
+	}
+	return d.published(topic, payload, client.Publish(topic, qos, retained, payload))
+}
+
+// intercept returns payload rewritten by Config.PublishInterceptor, as a string if payload is a string, empty
+// payloads clearing retained topics are sent as is
+func (d *device) intercept(topic string, payload interface{}) interface{} {
+	if d.config.PublishInterceptor == nil {
+		return payload
+	}
+	data := payloadBytes(payload)
+	if len(data) == 0 {
+		return payload
+	}
+	intercepted := d.config.PublishInterceptor(topic, data)
+	if _, ok := payload.(string); ok {
+		return string(intercepted)
+	}
+	return intercepted
+}
+
+// published call Config.OnPublished once token completes, returns token
+func (d *device) published(topic string, payload interface{}, token mqtt.Token) mqtt.Token {
+	if d.config.OnPublished == nil {
+		return token
+	}
+	go func() {
+		err := waitTokenTimeout(context.Background(), token, d.config.OperationTimeout)
+		d.config.OnPublished(topic, payloadBytes(payload), err)
+	}()
+	return token
+}
+
+func (d *device) countPublish(topic string, retained bool, payload interface{}) {
+	atomic.AddUint64(&d.stats.published, 1)
+	if retained {
+		d.trackRetained(topic, payload)
+	}
+}
+
+// trackRetained record topic value for Snapshot and Purge, an empty payload clears the retained message so the
+// topic is forgotten
+func (d *device) trackRetained(topic string, payload interface{}) {
+	var value string
+	switch p := payload.(type) {
+	case string:
+		value = p
+	case []byte:
+		value = string(p)
+	default:
+		value = fmt.Sprintf("%v", p)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if value == "" {
+		delete(d.retained, topic)
+		return
+	}
+	if d.retained == nil {
+		d.retained = make(map[string]string)
+	}
+	d.retained[topic] = value
+}
+
+func (d *device) Snapshot() map[string]string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	snapshot := make(map[string]string, len(d.retained))
+	for topic, value := range d.retained {
+		snapshot[topic] = value
+	}
+	return snapshot
 }
 
 func (d *device) DevicePublisher() DevicePublisher {
@@ -202,59 +968,541 @@ func (d *device) SetDevicePublisher(publisher DevicePublisher) Device {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	if d.publisher != nil {
-		panic(errors.New("DevicePublisher is already configured"))
+		panic(ErrPublisherAlreadySet)
 	}
 	d.publisher = publisher
 	return d
 }
 
+func (d *device) AddDevicePublisher(publisher DevicePublisher) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.publishers = append(d.publishers, publisher)
+	return d
+}
+
+func (d *device) SetStatsProvider(provider func() DeviceStatsReport) Device {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.statsProvider = provider
+	return d
+}
+
 func (d *device) PublishStats() {
-	diff := time.Since(d.Stats().StartupTime())
-	d.SendMessage("$stats/uptime", fmt.Sprintf("%d", uint64(diff.Seconds())))
+	d.mutex.Lock()
+	provider := d.statsProvider
+	d.mutex.Unlock()
+	var report DeviceStatsReport
+	if provider != nil {
+		report = provider()
+	}
+	if report.Uptime != nil {
+		d.SendMessage("$stats/uptime", fmt.Sprintf("%d", *report.Uptime))
+	} else {
+		diff := time.Since(d.Stats().StartupTime())
+		d.SendMessage("$stats/uptime", fmt.Sprintf("%d", uint64(diff.Seconds())))
+	}
+	if report.Signal != nil {
+		d.SendMessage("$stats/signal", fmt.Sprintf("%d", *report.Signal))
+	}
+	if report.Battery != nil {
+		d.SendMessage("$stats/battery", fmt.Sprintf("%d", *report.Battery))
+	}
+	if report.CPUTemp != nil {
+		d.SendMessage("$stats/cputemp", strconv.FormatFloat(*report.CPUTemp, 'f', -1, 64))
+	}
+	if report.CPULoad != nil {
+		d.SendMessage("$stats/cpuload", fmt.Sprintf("%d", *report.CPULoad))
+	}
+	if report.FreeHeap != nil {
+		d.SendMessage("$stats/freeheap", fmt.Sprintf("%d", *report.FreeHeap))
+	}
+	if report.Voltage != nil {
+		d.SendMessage("$stats/supply", strconv.FormatFloat(*report.Voltage, 'f', -1, 64))
+	}
 }
 
-func (d *device) initDevice() {
-	if !d.client.IsConnected() {
-		panic("not connected")
+func (d *device) Heartbeat() error {
+	if !d.IsConnected() {
+		return ErrNotConnected
 	}
-	d.SendMessage("$homie", HomieSpecVersion)
-	d.SendMessage("$name", d.name)
-	d.SendMessage("$localip", outboundIP())
-	d.SendMessage("$implementation", "homie-go")
-	d.SendMessage("$state", "ready")
-	d.SendMessage("$stats/interval", fmt.Sprintf("%d", d.config.StatsReportInterval))
+	d.setState(d.State())
+	return nil
+}
 
-	var nodeNames []string
+func (d *device) SetStatsInterval(seconds int) Device {
+	d.mutex.Lock()
+	d.config.StatsReportInterval = seconds
+	d.statsPeriod = 0
+	running := d.statsDone != nil
+	d.mutex.Unlock()
+	if running {
+		d.stopStats()
+		d.startStats()
+	}
+	if d.IsConnected() {
+		d.SendMessage("$stats/interval", fmt.Sprintf("%d", seconds))
+	}
+	return d
+}
+
+// statsInterval returns period of the stats goroutine, d.mutex must be held
+func (d *device) statsInterval() time.Duration {
+	if d.statsPeriod > 0 {
+		return d.statsPeriod
+	}
+	return time.Duration(d.config.StatsReportInterval) * time.Second
+}
+
+// startStats start publishing stats periodically until stopStats, publishing is skipped while disconnected
+func (d *device) startStats() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	interval := d.statsInterval()
+	if interval <= 0 || d.statsDone != nil {
+		return
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	d.statsDone = done
+	d.statsExited = exited
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if d.IsConnected() {
+					d.PublishStats()
+					d.Heartbeat()
+				}
+			}
+		}
+	}()
+}
+
+// stopStats stop the stats goroutine and wait for an in-flight publish to complete
+func (d *device) stopStats() {
+	d.mutex.Lock()
+	exited := d.statsExited
+	if d.statsDone != nil {
+		close(d.statsDone)
+		d.statsDone = nil
+		d.statsExited = nil
+	}
+	d.mutex.Unlock()
+	if exited != nil {
+		<-exited
+	}
+}
+
+// startIntervals republish properties with a publish interval periodically until stopIntervals, each property has
+// its own ticker, array properties are republished by the base property
+func (d *device) startIntervals() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.intervalsDone != nil {
+		return
+	}
+	done := make(chan struct{})
+	d.intervalsDone = done
 	for _, n := range d.nodes {
-		nodeNames = append(nodeNames, n.Name())
+		for _, name := range n.PropertyNames() {
+			p := n.GetProperty(name)
+			if interval := p.PublishInterval(); interval > 0 {
+				go d.publishEvery(p, interval, done)
+			}
+		}
+	}
+}
+
+func (d *device) publishEvery(p Property, interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if d.IsConnected() && hasValue(p) {
+				p.Publish()
+			}
+		}
+	}
+}
+
+func (d *device) stopIntervals() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.intervalsDone != nil {
+		close(d.intervalsDone)
+		d.intervalsDone = nil
+	}
+}
+
+// restartIntervals apply changed publish intervals, tickers only run while connected
+func (d *device) restartIntervals() {
+	d.mutex.Lock()
+	running := d.intervalsDone != nil
+	d.mutex.Unlock()
+	if running {
+		d.stopIntervals()
+		d.startIntervals()
+	}
+}
+
+// publishNodeList publish $nodes, array nodes are suffixed with []
+func (d *device) publishNodeList(nodes []Node) {
+	var nodeNames []string
+	for _, n := range nodes {
+		if n.ArrayLength() > 0 {
+			nodeNames = append(nodeNames, n.Name()+"[]")
+		} else {
+			nodeNames = append(nodeNames, n.Name())
+		}
 	}
 	d.SendMessage("$nodes", strings.Join(nodeNames, ","))
-	for _, n := range d.nodes {
+}
+
+// publishNodes publish nodes and their array instances, using up to Config.PublishConcurrency goroutines
+func (d *device) publishNodes(nodes []Node) {
+	publish := func(n Node) {
 		n.Publish()
+		for i := 0; i < n.ArrayLength(); i++ {
+			n.Index(i).Publish()
+		}
+	}
+	workers := d.config.PublishConcurrency
+	if workers <= 1 {
+		for _, n := range nodes {
+			publish(n)
+		}
+		return
 	}
+	jobs := make(chan Node)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				publish(n)
+			}
+		}()
+	}
+	for _, n := range nodes {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (d *device) initDevice() {
+	if !d.IsConnected() {
+		panic("not connected")
+	}
+	d.SendMessage("$homie", d.config.specVersion())
+	d.setState(StateInit) // controllers wait for ready before reading the tree
+	d.SendMessage("$name", d.name)
+	if ip, err := d.localIP(); err != nil {
+		d.config.logger().Warnf("Device %s $localip not published: %v", d.name, err)
+	} else {
+		d.SendMessage("$localip", ip)
+		if mac := interfaceMAC(ip); mac != "" {
+			d.SendMessage("$mac", mac)
+		}
+	}
+	d.SendMessage("$implementation", d.config.implementation())
+	if len(d.config.Extensions) > 0 {
+		d.SendMessage("$extensions", strings.Join(d.config.Extensions, ","))
+	}
+	if d.config.FirmwareName != "" {
+		d.SendMessage("$fw/name", d.config.FirmwareName)
+	}
+	if d.config.FirmwareVersion != "" {
+		d.SendMessage("$fw/version", d.config.FirmwareVersion)
+	}
+	d.mutex.Lock()
+	meta := d.meta
+	alert := d.alert
+	if alert != "" {
+		d.lastState = StateReady
+	}
+	clearAlert := alert == "" && d.alertPublished
+	d.alertPublished = alert != ""
+	statsInterval := d.config.StatsReportInterval
+	d.mutex.Unlock()
+	meta.publish(d, "")
+	d.SendMessage("$stats/interval", fmt.Sprintf("%d", statsInterval))
 
+	nodes := d.nodeList()
+	d.publishNodeList(nodes)
+	d.publishNodes(nodes)
+
+	d.mutex.Lock()
+	publishers := append([]DevicePublisher{}, d.publishers...)
 	if d.publisher != nil {
-		d.publisher(d)
+		publishers = append([]DevicePublisher{d.publisher}, publishers...)
+	}
+	d.mutex.Unlock()
+	for _, publisher := range publishers {
+		publisher(d)
 	}
 	d.PublishStats()
-	d.client.Subscribe(fmt.Sprintf("%s$broadcast/+", d.config.BaseTopic), 1, func(_ mqtt.Client, message mqtt.Message) {
-		if d.config.Mqtt.OnBroadcast != nil {
-			d.config.Mqtt.OnBroadcast(d, strings.TrimPrefix(message.Topic(), fmt.Sprintf("%s$broadcast/", d.config.BaseTopic)), message.Payload())
+
+	if alert != "" {
+		d.SendMessage("$alert", alert)
+		d.setState(StateAlert)
+	} else {
+		if clearAlert {
+			d.SendMessage("$alert", "")
 		}
-	})
+		d.setState(StateReady)
+	}
 }
 
-func (d *device) initNodes() {
+// localIP returns Config.LocalIP if set, the outbound IP otherwise
+func (d *device) localIP() (string, error) {
+	if d.config.LocalIP != "" {
+		return d.config.LocalIP, nil
+	}
+	return outboundIP()
+}
+
+// nodeList returns a snapshot of device nodes sorted by name, to iterate without holding the mutex
+func (d *device) nodeList() []Node {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	nodes := make([]Node, 0, len(d.nodes))
 	for _, n := range d.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name() < nodes[j].Name()
+	})
+	return nodes
+}
+
+// subscribe subscribe node properties, broadcasts and topics added with Subscribe, only once per connection
+func (d *device) subscribe() {
+	d.mutex.Lock()
+	if d.subscribed {
+		d.mutex.Unlock()
+		return
+	}
+	d.subscribed = true
+	d.mutex.Unlock()
+
+	for _, n := range d.nodeList() {
 		n.Subscribe()
-		if n.NodePublisher() != nil {
-			n.NodePublisher()(n) // invoke publishers
-		}
+	}
+	token := d.Client().Subscribe(d.broadcastTopic("+"), d.config.qos(), func(_ mqtt.Client, message mqtt.Message) {
+		d.onBroadcast(message.Topic(), message.Payload())
+	})
+	watchSubscribe(d, d.broadcastTopic("+"), token)
+
+	d.mutex.Lock()
+	subscriptions := make(map[string]subscription, len(d.subscriptions))
+	for topic, s := range d.subscriptions {
+		subscriptions[topic] = s
+	}
+	d.mutex.Unlock()
+	for topic, s := range subscriptions {
+		watchSubscribe(d, topic, d.subscribeTopic(topic, s.qos))
+	}
+}
+
+func (d *device) onBroadcast(topic string, payload []byte) {
+	d.config.logger().Debugf("Device %s received broadcast %s", d.name, topic)
+	level := strings.TrimPrefix(topic, d.broadcastTopic(""))
+	if d.config.Mqtt.OnBroadcast != nil {
+		d.config.Mqtt.OnBroadcast(d, level, payload)
+	}
+	d.mutex.Lock()
+	handlers := append([]func(Device, []byte){}, d.broadcastHandlers[level]...)
+	d.mutex.Unlock()
+	for _, handler := range handlers {
+		handler(d, payload)
+	}
+}
+
+func (d *device) initNodes() {
+	for _, n := range d.nodeList() {
+		invokeNodePublishers(n)
+	}
+}
+
+// invokeNodePublishers run publishers added with AddNodePublisher, or the NodePublisher of a custom node
+func invokeNodePublishers(n Node) {
+	if invoker, ok := n.(interface{ invokePublishers() }); ok {
+		invoker.invokePublishers()
+	} else if n.NodePublisher() != nil {
+		n.NodePublisher()(n)
 	}
 }
 
+func (d *device) State() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.state
+}
+
+func (d *device) setState(state string) mqtt.Token {
+	d.mutex.Lock()
+	d.state = state
+	d.mutex.Unlock()
+	if d.config.legacySpec() {
+		d.Publish("$online", PublishOptions{
+			Payload:  strconv.FormatBool(state == StateReady || state == StateAlert),
+			QoS:      d.config.stateQoS(),
+			Retained: d.config.stateRetained(),
+		})
+	}
+	return d.Publish("$state", PublishOptions{
+		Payload:  state,
+		QoS:      d.config.stateQoS(),
+		Retained: d.config.stateRetained(),
+	})
+}
+
+func (d *device) SetAlert(reason string) error {
+	if reason == "" {
+		return errors.New("alert reason is empty")
+	}
+	d.mutex.Lock()
+	if d.alert == "" {
+		d.lastState = d.state
+	}
+	d.alert = reason
+	connected := d.client != nil && d.client.IsConnected()
+	if connected {
+		d.alertPublished = true
+	}
+	d.mutex.Unlock()
+	if connected {
+		d.SendMessage("$alert", reason)
+		d.setState(StateAlert)
+	}
+	return nil
+}
+
+func (d *device) ClearAlert() error {
+	d.mutex.Lock()
+	if d.alert == "" {
+		d.mutex.Unlock()
+		return errors.New("no alert is set")
+	}
+	d.alert = ""
+	state := d.lastState
+	connected := d.client != nil && d.client.IsConnected()
+	if connected {
+		d.alertPublished = false
+	}
+	d.mutex.Unlock()
+	if !connected {
+		return nil
+	}
+	if state == "" {
+		state = StateReady
+	}
+	d.SendMessage("$alert", "")
+	d.setState(state)
+	return nil
+}
+
 func (d *device) Disconnect() error {
-	d.SendMessage("$state", "disconnected")
-	d.client.Disconnect(500)
+	return d.disconnect(StateDisconnected)
+}
+
+func (d *device) Reconnect() error {
+	previous := d.Client()
+	if previous == nil {
+		return ErrNotConnected
+	}
+	d.mutex.Lock()
+	runningStats := d.statsDone != nil
+	d.mutex.Unlock()
+	if d.IsConnected() {
+		if err := d.disconnect(StateDisconnected); err != nil {
+			d.config.logger().Warnf("Device %s reconnect: %v", d.name, err)
+		}
+	} else {
+		// paho may still be auto-reconnecting, two sessions with the same client id would kick each other off
+		d.stopStats()
+		previous.Disconnect(0)
+	}
+	if err := d.Connect(); err != nil {
+		return err
+	}
+	if runningStats {
+		d.startStats()
+	}
 	return nil
 }
+
+func (d *device) Purge() error {
+	if !d.IsConnected() {
+		return ErrNotConnected
+	}
+	d.stopStats()
+	d.stopIntervals()
+	d.mutex.Lock()
+	d.closing = true
+	topics := make([]string, 0, len(d.retained))
+	for topic := range d.retained {
+		topics = append(topics, topic)
+	}
+	d.state = StateDisconnected
+	d.mutex.Unlock()
+	sort.Strings(topics)
+
+	quiesce := d.config.Mqtt.quiesce()
+	deadline := time.Now().Add(d.config.disconnectTimeout())
+	tokens := make([]mqtt.Token, 0, len(topics))
+	for _, topic := range topics {
+		tokens = append(tokens, d.PublishRaw(topic, d.config.qos(), true, ""))
+	}
+	var err error
+	for _, token := range tokens {
+		if !token.WaitTimeout(time.Until(deadline)) {
+			err = errors.New("timeout purging retained topics")
+			break
+		}
+		if token.Error() != nil {
+			err = token.Error()
+			break
+		}
+	}
+	d.Client().Disconnect(uint(quiesce / time.Millisecond))
+	return err
+}
+
+func (d *device) Sleep() error {
+	return d.disconnect(StateSleeping)
+}
+
+// disconnect publish state and wait up to OperationTimeout or quiesce for the broker to receive it before disconnecting
+func (d *device) disconnect(state string) error {
+	client := d.Client()
+	if client == nil {
+		return ErrNotConnected
+	}
+	d.mutex.Lock()
+	d.closing = true
+	d.mutex.Unlock()
+	d.stopStats()
+	d.stopIntervals()
+	quiesce := d.config.Mqtt.quiesce()
+	token := d.setState(state)
+	var err error
+	if !token.WaitTimeout(d.config.disconnectTimeout()) {
+		err = fmt.Errorf("timeout publishing $state %s", state)
+	} else {
+		err = token.Error()
+	}
+	client.Disconnect(uint(quiesce / time.Millisecond))
+	return err
+}
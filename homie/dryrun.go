@@ -0,0 +1,57 @@
+package homie
+
+import (
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// dryRunAdapter adapter used when Config.DryRun is set, publishes are logged instead of sent and subscriptions are
+// ignored, no broker connection is made
+type dryRunAdapter struct {
+	options   *mqtt.ClientOptions
+	logger    Logger
+	mutex     sync.Mutex
+	connected bool
+}
+
+func newDryRunAdapter(options *mqtt.ClientOptions, logger Logger) MqttAdapter {
+	return &dryRunAdapter{
+		options: options,
+		logger:  logger,
+	}
+}
+
+func (a *dryRunAdapter) Connect() mqtt.Token {
+	a.mutex.Lock()
+	a.connected = true
+	a.mutex.Unlock()
+	a.logger.Infof("Dry run: connected as %s", a.options.ClientID)
+	if a.options.OnConnect != nil {
+		a.options.OnConnect(nil)
+	}
+	return &errorToken{}
+}
+
+func (a *dryRunAdapter) IsConnected() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.connected
+}
+
+func (a *dryRunAdapter) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	a.logger.Infof("Dry run: publish %s qos=%d retained=%t: %s", topic, qos, retained, payload)
+	return &errorToken{}
+}
+
+func (a *dryRunAdapter) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	a.logger.Debugf("Dry run: subscribe %s qos=%d", topic, qos)
+	return &errorToken{}
+}
+
+func (a *dryRunAdapter) Disconnect(quiesce uint) {
+	a.mutex.Lock()
+	a.connected = false
+	a.mutex.Unlock()
+	a.logger.Infof("Dry run: disconnected")
+}
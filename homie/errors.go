@@ -0,0 +1,37 @@
+package homie
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by devices, test them with errors.Is as they are usually wrapped with details
+var (
+	// ErrNodeAlreadyExists a node with the same name is already added to the device
+	ErrNodeAlreadyExists = errors.New("node already exists")
+	// ErrNotConnected the operation needs a connected client
+	ErrNotConnected = errors.New("not connected")
+	// ErrInvalidID a device, node or property id is not valid, see ValidateID and IDError
+	ErrInvalidID = errors.New("invalid id")
+	// ErrPublisherAlreadySet a DevicePublisher is already set, see Device.AddDevicePublisher
+	ErrPublisherAlreadySet = errors.New("DevicePublisher is already configured")
+	// ErrTimeout an operation did not complete within Config.OperationTimeout
+	ErrTimeout = errors.New("operation timed out")
+	// ErrWildcardTopic a publish topic or topic id contains the MQTT wildcards + or #
+	ErrWildcardTopic = errors.New("topic contains MQTT wildcard")
+)
+
+// IDError error returned by ValidateID, matches ErrInvalidID with errors.Is
+type IDError struct {
+	ID     string
+	Reason string
+}
+
+func (e *IDError) Error() string {
+	return fmt.Sprintf("%s: %q", e.Reason, e.ID)
+}
+
+// Is returns true for ErrInvalidID
+func (e *IDError) Is(target error) bool {
+	return target == ErrInvalidID
+}
@@ -0,0 +1,34 @@
+package homie
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type healthReport struct {
+	State       string    `json:"state"`
+	Connected   bool      `json:"connected"`
+	Uptime      uint64    `json:"uptime"` // seconds since device startup
+	ConnectTime time.Time `json:"connect_time"`
+}
+
+// HealthHandler returns a handler for liveness and readiness probes, responding 200 when the device is connected
+// and $state is ready, 503 otherwise, with state, uptime and connect time as JSON body
+func HealthHandler(d Device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := healthReport{
+			State:       d.State(),
+			Connected:   d.IsConnected(),
+			Uptime:      uint64(time.Since(d.Stats().StartupTime()).Seconds()),
+			ConnectTime: d.Stats().ConnectTime(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Connected && report.State == StateReady {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
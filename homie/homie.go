@@ -1,19 +1,44 @@
 package homie
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 const (
-	// HomieSpecVersion Homie convention version
+	// HomieSpecVersion Homie convention version, default of Config.SpecVersion
 	HomieSpecVersion = "3.0.1"
 )
 
-// PropertyHandler a handler function type for a propery
+// Device lifecycle states, published as $state
+const (
+	StateInit         = "init"
+	StateReady        = "ready"
+	StateDisconnected = "disconnected"
+	StateSleeping     = "sleeping"
+	StateLost         = "lost"
+	StateAlert        = "alert"
+)
+
+// PropertyHandler a handler function type for a propery, returning true and a nil error confirms the payload
+// as the new property value
 type PropertyHandler func(p Property, payload []byte, topic string) (bool, error)
 
-// MqttAdapter adapter for paho mqtt, to make it testable
+// MqttAdapter transport used by devices and controllers, implemented with paho mqtt by default, a custom adapter
+// can be supplied with MqttConfig.ClientFactory or Device.SetClient to use another transport or an in-process bus.
+// Methods may be called from multiple goroutines, tokens must complete once the operation is done or failed.
 type MqttAdapter interface {
+	// Connect will create a connection to the message broker
+	Connect() mqtt.Token
+
 	// IsConnected returns a bool signifying whether
 	// the client is connected or not.
 	IsConnected() bool
@@ -24,16 +49,239 @@ type MqttAdapter interface {
 	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
 
 	// Subscribe starts a new subscription. Provide a MessageHandler to be executed when
-	// a message is published on the topic provided, or nil for the default handler
+	// a message is published on the topic provided, or nil for the default handler.
+	// topic is an MQTT filter, adapters must match + and # wildcards, e.g. devices subscribe <node>/+/set
 	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
 
+	// Disconnect will end the connection, waiting up to quiesce milliseconds for pending work
 	Disconnect(quiesce uint)
 }
 
+// MqttV5Adapter adapter supporting MQTT 5 publish properties, used when MqttConfig.ProtocolVersion is 5
+type MqttV5Adapter interface {
+	MqttAdapter
+	// PublishWithProperties publish like Publish with MQTT 5 properties
+	PublishWithProperties(topic string, qos byte, retained bool, payload interface{}, properties *PublishProperties) mqtt.Token
+}
+
+// MqttUnsubscriber adapter able to end subscriptions, used by Device.Unsubscribe, implemented by the paho adapter
+type MqttUnsubscriber interface {
+	// Unsubscribe end subscriptions of topics, messages are no longer delivered once the token completes
+	Unsubscribe(topics ...string) mqtt.Token
+}
+
+// ConnectionInfoProvider adapter reporting the broker and session of the current connection, used by
+// Device.ConnectionInfo instead of guessing them from the options and connect token
+type ConnectionInfoProvider interface {
+	ConnectionInfo() ConnectionInfo
+}
+
+// ConnectionInfo details of the current broker connection
+type ConnectionInfo struct {
+	// BrokerURL broker of the connection, empty with several brokers unless the adapter is a ConnectionInfoProvider
+	BrokerURL string
+	// SessionPresent broker resumed a previous session, see MqttConfig.CleanSession, only known for connections
+	// made by Connect, not for automatic reconnects of the paho client
+	SessionPresent bool
+	ClientID       string
+	ConnectedAt    time.Time
+}
+
+// PublishProperties MQTT 5 publish properties
+type PublishProperties struct {
+	ContentType    string
+	UserProperties map[string]string
+}
+
+// MqttClientFactory creates the MqttAdapter used by a device to talk to the broker, the adapter must call
+// options.OnConnect after each successful connection and options.OnConnectionLost when the connection drops
+type MqttClientFactory func(options *mqtt.ClientOptions) MqttAdapter
+
 type mqttClientDelegate struct {
 	client mqtt.Client
 }
 
+// newClientOptions create broker connection options shared by devices and controllers, clientID is used unless
+// MqttConfig.ClientID is set, credentials of the first broker URL with userinfo are used if Username or Password
+// are empty
+func newClientOptions(clientID string, cfg *MqttConfig) (*mqtt.ClientOptions, error) {
+	brokers := cfg.brokers()
+	var serverName string
+	var userinfo *url.Userinfo
+	for i, broker := range brokers {
+		brokerURL, err := url.Parse(broker)
+		if err != nil {
+			return nil, err
+		}
+		if len(brokers) == 1 {
+			serverName = brokerURL.Hostname()
+		}
+		if brokerURL.User != nil {
+			if userinfo == nil {
+				userinfo = brokerURL.User
+			}
+			// credentials are sent with the connect packet, not as part of the broker address
+			brokerURL.User = nil
+			brokers[i] = brokerURL.String()
+		}
+	}
+	tlsConfig := cfg.TLSConfig
+	if tlsConfig == nil {
+		var err error
+		// with several brokers the server name is taken from the address of each connection
+		tlsConfig, err = newTLSConfig(serverName, cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := mqtt.NewClientOptions()
+	for _, broker := range brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetUsername(cfg.Username)
+	opts.SetPassword(cfg.Password)
+	if userinfo != nil {
+		if cfg.Username == "" {
+			opts.SetUsername(userinfo.Username())
+		}
+		if password, set := userinfo.Password(); set && cfg.Password == "" {
+			opts.SetPassword(password)
+		}
+	}
+	opts.SetClientID(cfg.clientID(clientID))
+	opts.SetTLSConfig(tlsConfig)
+	switch cfg.ProtocolVersion {
+	case 0:
+	case 3, 4:
+		opts.SetProtocolVersion(cfg.ProtocolVersion)
+	case 5:
+		if cfg.ClientFactory == nil {
+			return nil, errors.New("MQTT 5 is not supported by the paho client, set ClientFactory to an MqttV5Adapter")
+		}
+		opts.ProtocolVersion = 5 // not accepted by SetProtocolVersion, read by the factory
+	default:
+		return nil, fmt.Errorf("unsupported MQTT protocol version: %d", cfg.ProtocolVersion)
+	}
+	opts.SetAutoReconnect(true)
+	if cfg.AutoReconnect != nil {
+		opts.SetAutoReconnect(*cfg.AutoReconnect)
+	}
+	if cfg.CleanSession != nil {
+		opts.SetCleanSession(*cfg.CleanSession)
+	}
+	if cfg.KeepAlive > 0 {
+		opts.SetKeepAlive(cfg.KeepAlive)
+	}
+	if cfg.MaxReconnectInterval > 0 {
+		opts.SetMaxReconnectInterval(cfg.MaxReconnectInterval)
+	}
+	return opts, nil
+}
+
+// newTLSConfig create tls.Config for serverName, loading CA and client certificate files if configured
+func newTLSConfig(serverName string, options *TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+	}
+	if options == nil {
+		return tlsConfig, nil
+	}
+	tlsConfig.InsecureSkipVerify = options.InsecureSkipVerify
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not read CA file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file: %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newMqttClient create adapter using configured ClientFactory, or paho client if not set
+func newMqttClient(cfg *MqttConfig, options *mqtt.ClientOptions) MqttAdapter {
+	if cfg.ClientFactory != nil {
+		return cfg.ClientFactory(options)
+	}
+	return newMqttClientDelegate(options)
+}
+
+// waitToken wait for token completion, returns ctx.Err() if ctx is done first
+func waitToken(ctx context.Context, token mqtt.Token) error {
+	done := make(chan struct{})
+	go func() {
+		for !token.WaitTimeout(3 * time.Second) {
+		}
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+	}
+	return token.Error()
+}
+
+// waitTokenTimeout wait like waitToken, returns an error matching ErrTimeout if token is not completed within
+// timeout, no limit if timeout is 0
+func waitTokenTimeout(ctx context.Context, token mqtt.Token, timeout time.Duration) error {
+	if timeout <= 0 {
+		return waitToken(ctx, token)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := waitToken(timeoutCtx, token)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return fmt.Errorf("%w after %v", ErrTimeout, timeout)
+	}
+	return err
+}
+
+// closeAborted disconnect client of an abandoned connect once its connect token completes, the adapter may
+// still be connecting and paho does not support a disconnect racing an in-flight connect
+func closeAborted(client MqttAdapter, token mqtt.Token) {
+	go func() {
+		token.Wait()
+		client.Disconnect(0)
+	}()
+}
+
+// errorToken completed token, err is set for operations which failed before reaching the adapter
+type errorToken struct {
+	err error
+}
+
+func (t *errorToken) Wait() bool {
+	return true
+}
+
+func (t *errorToken) WaitTimeout(_ time.Duration) bool {
+	return true
+}
+
+func (t *errorToken) Error() error {
+	return t.err
+}
+
+func newMqttClientDelegate(options *mqtt.ClientOptions) MqttAdapter {
+	return &mqttClientDelegate{
+		client: mqtt.NewClient(options),
+	}
+}
+
+func (a *mqttClientDelegate) Connect() mqtt.Token {
+	return a.client.Connect()
+}
+
 func (a *mqttClientDelegate) IsConnected() bool {
 	return a.client.IsConnected()
 }
@@ -45,6 +293,11 @@ func (a *mqttClientDelegate) Publish(topic string, qos byte, retained bool, payl
 func (a *mqttClientDelegate) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
 	return a.client.Subscribe(topic, qos, callback)
 }
+
+func (a *mqttClientDelegate) Unsubscribe(topics ...string) mqtt.Token {
+	return a.client.Unsubscribe(topics...)
+}
+
 func (a *mqttClientDelegate) Disconnect(quiesce uint) {
 	a.client.Disconnect(quiesce)
 }
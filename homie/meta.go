@@ -0,0 +1,66 @@
+package homie
+
+import (
+	"strings"
+)
+
+// metadata key/value pairs of the Homie meta extension (org.homie.meta), published under <prefix>$meta:
+// $meta/$mainkey-ids lists key ids, $meta/<id>/$key and $meta/<id>/$value hold each pair
+type metadata struct {
+	ids    []string
+	keys   map[string]string
+	values map[string]string
+}
+
+// metaID derive a topic id from key, lowercase with characters other than a-z, 0-9 and '-' replaced by '-'
+func metaID(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, key)
+}
+
+// set add or replace value of key, keys keep insertion order
+func (m *metadata) set(key string, value string) {
+	if m.keys == nil {
+		m.keys = make(map[string]string)
+		m.values = make(map[string]string)
+	}
+	id := metaID(key)
+	if _, found := m.keys[id]; !found {
+		m.ids = append(m.ids, id)
+	}
+	m.keys[id] = key
+	m.values[id] = value
+}
+
+// clone returns a copy not sharing keys with m
+func (m metadata) clone() metadata {
+	c := metadata{ids: append([]string(nil), m.ids...)}
+	if m.keys != nil {
+		c.keys = make(map[string]string, len(m.keys))
+		c.values = make(map[string]string, len(m.values))
+		for id := range m.keys {
+			c.keys[id] = m.keys[id]
+			c.values[id] = m.values[id]
+		}
+	}
+	return c
+}
+
+// publish send the meta tree, topics are relative to the owner, e.g. "" for a device or "node/" for a node
+func (m *metadata) publish(d Device, prefix string) {
+	if len(m.ids) == 0 {
+		return
+	}
+	d.SendMessage(prefix+"$meta/$mainkey-ids", strings.Join(m.ids, ","))
+	for _, id := range m.ids {
+		d.SendMessage(prefix+"$meta/"+id+"/$key", m.keys[id])
+		d.SendMessage(prefix+"$meta/"+id+"/$value", m.values[id])
+	}
+}
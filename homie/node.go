@@ -5,44 +5,146 @@ import (
 	"log"
 	"sort"
 	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // Node homie node type
 type Node interface {
+	// Name returns node id, used in topics
 	Name() string
+	// DisplayName returns human friendly name published as $name, defaults to Name()
+	DisplayName() string
+	// SetName set human friendly name, published as $name
+	SetName(name string) Node
 	Type() string
 	Device() Device
 	SetDevice(d Device) Node
 
 	NewProperty(name string, propertyType string) Property
+	// AddProperty add a property, panics if already added, when connected $properties and the property attributes
+	// are published, call Subscribe once a handler is set to receive values
 	AddProperty(p Property) Property
 	GetProperty(name string) Property
 	// return sorted slice of node properties
 	PropertyNames() []string
 
+	// SetMeta set a meta extension key/value pair, published under node/$meta
+	SetMeta(key string, value string) Node
+	// AddTag add a label for controller grouping, e.g. diagnostics, published as node/$tags with the attributes
+	AddTag(tag string) Node
+	// Tags returns labels added with AddTag, in insertion order
+	Tags() []string
+
 	NodePublisher() NodePublisher
+	// SetNodePublisher set the publisher called during device initialisation
 	SetNodePublisher(publisher NodePublisher) Node
+	// AddNodePublisher add a publisher called during device initialisation after the one set with
+	// SetNodePublisher, publishers are called in the order they were added
+	AddNodePublisher(publisher NodePublisher) Node
 
-	// NodeTopic returns relative topic name for a part, for example timeNode/currentTime
+	// NodeTopic returns relative topic name for a part, for example timeNode/currentTime, wildcards + and # are
+	// removed from the node id
 	NodeTopic(part string) string
+	// Topic returns fully qualified topic of a node part, for example homie/device/timeNode/currentTime, the node
+	// topic itself if part is empty
+	Topic(part string) string
+
+	// ArrayLength returns number of array instances, 0 if the node is not an array
+	ArrayLength() int
+	// Index returns array instance i (topic node_i), nil if the node is not an array or i is out of range
+	Index(i int) Node
 
+	// Publish publish node attributes and current value of properties with a value, with Config.LazyMetadata
+	// nothing is published until a property has a value
 	Publish() Node
-	// Subscribe subscribe node properties
+	// Subscribe subscribe to node/+/set if a property is settable, messages are dispatched to the property
+	// named in the topic
 	Subscribe() Node
 }
 
 type node struct {
-	id         string
-	name       string
-	nodeType   string
-	device     Device
-	properties map[string]Property
-	publisher  NodePublisher
+	id          string
+	name        string
+	displayName string
+	nodeType    string
+	device      Device
+	properties  map[string]Property
+	publisher   NodePublisher
+	instances   []*node // array instances
+	base        *node   // set on array instances
+	meta        metadata
+	tags        tags
+
+	publishers []NodePublisher // added with AddNodePublisher
+
+	metadataMutex     sync.Mutex
+	metadataPublished bool // attributes published since connect, see Config.LazyMetadata
+}
+
+func newArrayNode(name string, nodeType string, length int) *node {
+	n := &node{
+		name:     name,
+		nodeType: nodeType,
+	}
+	for i := 0; i < length; i++ {
+		n.instances = append(n.instances, &node{
+			name:     fmt.Sprintf("%s_%d", name, i),
+			nodeType: nodeType,
+			base:     n,
+		})
+	}
+	return n
+}
+
+// clone returns a deep copy of the node and its properties, not attached to a device
+func (n *node) clone() *node {
+	c := &node{
+		name:     n.name,
+		nodeType: n.nodeType,
+	}
+	if len(n.instances) > 0 {
+		c = newArrayNode(n.name, n.nodeType, len(n.instances))
+	}
+	c.displayName = n.displayName
+	c.publisher = n.publisher
+	c.publishers = append([]NodePublisher(nil), n.publishers...)
+	c.meta = n.meta.clone()
+	c.tags = append(tags(nil), n.tags...)
+	for _, name := range n.PropertyNames() {
+		if p, ok := n.properties[name].(*property); ok {
+			c.AddProperty(p.clone())
+		}
+	}
+	for i, instance := range n.instances {
+		c.instances[i].displayName = instance.displayName
+		c.instances[i].meta = instance.meta.clone()
+		for name, p := range instance.properties {
+			if p, ok := p.(*property); ok && c.instances[i].properties[name] != nil {
+				cp := p.clone()
+				cp.base = c.properties[name]
+				cp.node = c.instances[i]
+				c.instances[i].properties[name] = cp
+			}
+		}
+	}
+	return c
 }
 
 func (n *node) Name() string {
 	return n.name
 }
+func (n *node) DisplayName() string {
+	if n.displayName == "" {
+		return n.name
+	}
+	return n.displayName
+}
+func (n *node) SetName(name string) Node {
+	n.displayName = name
+	return n
+}
 func (n *node) Type() string {
 	return n.nodeType
 }
@@ -51,8 +153,27 @@ func (n *node) Device() Device {
 }
 func (n *node) SetDevice(d Device) Node {
 	n.device = d
+	for _, instance := range n.instances {
+		instance.device = d
+	}
 	return n
 }
+func (n *node) SetMeta(key string, value string) Node {
+	n.meta.set(key, value)
+	return n
+}
+func (n *node) AddTag(tag string) Node {
+	n.tags.add(tag)
+	return n
+}
+
+func (n *node) Tags() []string {
+	if n.base != nil {
+		return n.base.Tags()
+	}
+	return append([]string(nil), n.tags...)
+}
+
 func (n *node) NodePublisher() NodePublisher {
 	return n.publisher
 }
@@ -61,6 +182,21 @@ func (n *node) SetNodePublisher(publisher NodePublisher) Node {
 	return n
 }
 
+func (n *node) AddNodePublisher(publisher NodePublisher) Node {
+	n.publishers = append(n.publishers, publisher)
+	return n
+}
+
+// invokePublishers call the node publisher then added ones
+func (n *node) invokePublishers() {
+	if n.publisher != nil {
+		n.publisher(n)
+	}
+	for _, publisher := range n.publishers {
+		publisher(n)
+	}
+}
+
 func (n *node) GetProperty(name string) Property {
 	return n.properties[name]
 }
@@ -81,6 +217,22 @@ func (n *node) AddProperty(p Property) Property {
 		log.Panic(fmt.Errorf("Property %s already added to node: %s", p.Name(), n.name))
 	}
 	n.properties[p.Name()] = p
+	for _, instance := range n.instances {
+		instance.AddProperty(&property{
+			name: p.Name(),
+			base: p,
+		})
+	}
+	if n.base == nil && n.device != nil && n.device.IsConnected() && n.device.GetNode(n.name) == Node(n) {
+		// added after connect, attributes set later are published on next connect
+		if n.isMetadataPublished() || !n.device.Config().LazyMetadata {
+			n.publishPropertyList()
+			p.PublishAttributes()
+		}
+		if len(n.instances) == 0 && hasValue(p) {
+			p.Publish()
+		}
+	}
 	return p
 }
 
@@ -94,26 +246,176 @@ func (n *node) PropertyNames() []string {
 }
 
 func (n *node) NodeTopic(part string) string {
-	return fmt.Sprintf("%s/%s", n.name, part)
+	name, err := escapeTopic(n.name)
+	if err != nil && n.device != nil {
+		n.device.Config().logger().Errorf("Node %s topic: %v", n.name, err)
+	}
+	return fmt.Sprintf("%s/%s", name, part)
+}
+
+func (n *node) Topic(part string) string {
+	if part == "" {
+		return strings.TrimSuffix(n.device.Topic(n.NodeTopic("")), "/")
+	}
+	return n.device.Topic(n.NodeTopic(part))
+}
+
+func (n *node) ArrayLength() int {
+	return len(n.instances)
+}
+
+func (n *node) Index(i int) Node {
+	if i < 0 || i >= len(n.instances) {
+		return nil
+	}
+	return n.instances[i]
 }
 
 func (n *node) Subscribe() Node {
+	if len(n.instances) > 0 {
+		// array values are set per instance
+		for _, instance := range n.instances {
+			instance.Subscribe()
+		}
+		return n
+	}
+	settable := false
 	for _, p := range n.properties {
-		p.Subscribe()
+		settable = settable || p.Settable()
+	}
+	if !settable {
+		return n
 	}
+	topic := n.Topic("+/set")
+	token := n.device.Client().Subscribe(topic, n.device.Config().qos(), func(client mqtt.Client, message mqtt.Message) {
+		n.onSetMessage(message.Topic(), message.Payload())
+	})
+	watchSubscribe(n.device, topic, token)
 	return n
 }
 
+// onSetMessage dispatch a message received on node/+/set to the property named in the topic
+func (n *node) onSetMessage(topic string, payload []byte) {
+	logger := n.device.Config().logger()
+	root := n
+	if n.base != nil {
+		root = n.base
+	}
+	if n.device.GetNode(root.name) != Node(root) {
+		logger.Debugf("Ignored message for removed node: %s, topic: %s", root.name, topic)
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(topic, n.Topic("")+"/"), "/set")
+	p := n.properties[name]
+	if p == nil {
+		logger.Warnf("Unknown property: %s, topic: %s", name, topic)
+		return
+	}
+	if !p.Settable() {
+		logger.Debugf("Ignored value for property not settable: %s, topic: %s", name, topic)
+		return
+	}
+	if receiver, ok := p.(interface{ onMessage(string, []byte) }); ok {
+		receiver.onMessage(topic, payload)
+		return
+	}
+	if p.Handler() != nil {
+		p.Handler()(p, payload, topic)
+	}
+}
+
 func (n *node) Publish() Node {
-	n.device.SendMessage(n.NodeTopic("$name"), n.name)
+	lazy := n.device.Config().LazyMetadata && !n.anyValue()
+	n.metadataMutex.Lock()
+	n.metadataPublished = !lazy
+	n.metadataMutex.Unlock()
+	if lazy {
+		// attributes are published with the first value, see ensureMetadata
+		return n
+	}
+	n.publishMetadata()
+	for _, p := range n.properties {
+		if len(n.instances) == 0 && hasValue(p) {
+			p.Publish() // array values are published by instances
+		}
+	}
+	return n
+}
+
+// publishMetadata publish node and property attributes, array instances only publish $name as the other
+// attributes are published by the base node
+func (n *node) publishMetadata() {
+	n.device.SendMessage(n.NodeTopic("$name"), n.DisplayName())
+	if n.base != nil {
+		return
+	}
 	n.device.SendMessage(n.NodeTopic("$type"), n.nodeType)
-	var propNames []string
+	n.publishPropertyList()
+	if len(n.instances) > 0 {
+		n.device.SendMessage(n.NodeTopic("$array"), fmt.Sprintf("0-%d", len(n.instances)-1))
+	}
+	n.meta.publish(n.device, n.NodeTopic(""))
+	n.tags.publish(n.device, n.NodeTopic(""))
 	for _, p := range n.properties {
-		propNames = append(propNames, p.Name())
+		p.PublishAttributes()
+	}
+}
+
+// ensureMetadata publish attributes not published yet with Config.LazyMetadata, called before a property value
+// is published, array instances publish the base node attributes first
+func (n *node) ensureMetadata() {
+	if n.base != nil {
+		n.base.ensureMetadata()
+	}
+	n.metadataMutex.Lock()
+	published := n.metadataPublished
+	n.metadataPublished = true
+	n.metadataMutex.Unlock()
+	if !published {
+		n.publishMetadata()
 	}
-	n.Device().SendMessage(n.NodeTopic("$properties"), strings.Join(propNames, ","))
+}
+
+func (n *node) isMetadataPublished() bool {
+	n.metadataMutex.Lock()
+	defer n.metadataMutex.Unlock()
+	return n.metadataPublished
+}
+
+// anyValue returns true if a property of the node or of its array instances has a value
+func (n *node) anyValue() bool {
 	for _, p := range n.properties {
-		p.Publish()
+		if len(n.instances) == 0 && hasValue(p) {
+			return true
+		}
 	}
-	return n
+	for _, instance := range n.instances {
+		if instance.anyValue() {
+			return true
+		}
+	}
+	return false
+}
+
+// publishPropertyList publish $properties with sorted property ids, settable ids are suffixed with :settable for
+// Homie 2.x
+func (n *node) publishPropertyList() {
+	names := n.PropertyNames()
+	if n.device.Config().legacySpec() {
+		for i, name := range names {
+			if n.properties[name].Settable() {
+				names[i] = name + ":settable"
+			}
+		}
+	}
+	n.device.SendMessage(n.NodeTopic("$properties"), strings.Join(names, ","))
+}
+
+// hasValue returns true if a value was set, an empty value of a property never set is not published as it would
+// clear the retained value
+func hasValue(p Property) bool {
+	if v, ok := p.(interface{ hasValue() bool }); ok {
+		return v.hasValue()
+	}
+	return p.Value() != ""
 }
@@ -1,56 +1,503 @@
 package homie
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 // Property homie node property
 type Property interface {
+	// Name returns property id, used in topics
 	Name() string
+	// DisplayName returns human friendly name published as $name, defaults to Name()
+	DisplayName() string
+	// SetName set human friendly name, published as $name
+	SetName(name string) Property
 	Type() string
+	// Value returns the last value stored by SetValue, Set or a confirmed /set message
 	Value() string
 	SetValue(value string) Property
+	// InitialValue returns the value set with SetInitialValue, false if not set
+	InitialValue() (string, bool)
+	// SetInitialValue set the value published with the property attributes until a value is set, Value returns it
+	// until then, array instances use the initial value of the array property
+	SetInitialValue(value string) Property
+	// Set validate value against the datatype, store it and publish it if connected, see SetThrottle and SetDeadband,
+	// safe for concurrent use, the last value published is the stored value
+	Set(value string) error
+	// SetThrottle publish values stored by Set at most once per interval, the latest value is published when the
+	// interval ends, 0 disables throttling
+	SetThrottle(interval time.Duration) Property
+	// SetDeadband skip publishing values stored by Set that differ from the last published value by less than delta,
+	// only applies to integer and float properties
+	SetDeadband(delta float64) Property
+	// PublishInterval returns the periodic republish interval, 0 if disabled
+	PublishInterval() time.Duration
+	// SetPublishInterval republish the current value every interval while the device is connected, even if
+	// unchanged, 0 disables it
+	SetPublishInterval(interval time.Duration) Property
+	// SetJSON marshal v to JSON and Set it, nothing is stored or published if marshaling fails
+	SetJSON(v interface{}) error
+	// GetJSON unmarshal current value into out
+	GetJSON(out interface{}) error
+	// SetBool set $datatype boolean and Set the value as true or false
+	SetBool(value bool) error
+	// Bool parse current value, returns an error unless it is exactly true or false
+	Bool() (bool, error)
+	// SetPercent set $unit % and Set v, $format defaults to 0:100 unless already a range, $datatype defaults to
+	// float, an integer property only accepts whole numbers, returns an error if v is out of range
+	SetPercent(v float64) error
+	// SetEnum set $datatype enum and $format to the comma separated values, empty and duplicate values are dropped
+	SetEnum(values []string) Property
+	// SetEnumValue Set v, returns an error if v is not one of the values of SetEnum or $datatype is not enum
+	SetEnumValue(v string) error
+	// SetRGB set $datatype color with $format rgb and Set the color
+	SetRGB(r, g, b uint8) error
+	// SetHSV set $datatype color with $format hsv and Set the color, returns an error if hue is out of 0-360 or
+	// saturation or value out of 0-100
+	SetHSV(h, s, v int) error
+	// RGB parse current value as an rgb color
+	RGB() (RGB, error)
+	// HSV parse current value as an hsv color
+	HSV() (HSV, error)
+	Datatype() Datatype
+	// SetDatatype set property datatype, published as $datatype
+	SetDatatype(dt Datatype) Property
+	Format() string
+	// SetFormat set property format, published as $format and used to validate values, see Datatype.ValidateFormat
+	SetFormat(format string) Property
+	Unit() string
+	// SetUnit set property unit like °C or %, published as $unit
+	SetUnit(unit string) Property
+	// Retained returns whether values are published with retain flag, defaults to true
+	Retained() bool
+	// SetRetained set retain flag of published values, published as $retained
+	SetRetained(retained bool) Property
+	// SetMeta set a meta extension key/value pair, published under node/prop/$meta
+	SetMeta(key string, value string) Property
+	// AddTag add a label for controller grouping, e.g. diagnostics, published as node/prop/$tags with the attributes
+	AddTag(tag string) Property
+	// Tags returns labels added with AddTag, in insertion order
+	Tags() []string
 	Node() Node
 	SetNode(n Node) Property
-	// Publish send current value as MQTT payload, topic will be Node().Topic(Name())
+	// Topic returns fully qualified topic of a property part, for example homie/device/node/prop/$unit, the value
+	// topic if part is empty
+	Topic(part string) string
+	// Publish send current value as MQTT payload, topic will be Topic("")
 	Publish() Property
+	// PublishAttributes send property attributes like $datatype, called by Node.Publish
+	PublishAttributes() Property
 
-	// Subscribe called during initialisation, subscribe to MQTT topic: device/node/prop/set if property Handler is set
+	// Subscribe subscribe to MQTT topic: device/node/prop/set if property is settable, not needed for properties
+	// of a subscribed node, see Node.Subscribe
 	Subscribe() Property
 
+	// PublishQoS QoS used to publish property value, defaults to device Config QoS
+	PublishQoS() byte
+	SetPublishQoS(qos byte) Property
+
+	// Settable returns true if values are accepted on device/node/prop/set, defaults to true when a handler is set
+	Settable() bool
+	// SetSettable set whether values are accepted on /set, published as $settable, a settable property without
+	// handler stores and republishes every valid value it receives
+	SetSettable(settable bool) Property
 	Handler() PropertyHandler
 	// SetHandler set handler for incomming MQTT messages, by setting Handler, the property will be settable (topic: device/node/prop/set)
 	SetHandler(h PropertyHandler) Property
+	// OnSet set handler for values received on device/node/prop/set, when handler returns nil the value is stored
+	// and republished as confirmation, an error rejects the value
+	OnSet(handler func(value string) error) Property
 }
 
 type property struct {
 	name         string
+	displayName  string
 	propertyType string
 	value        string
 	handler      PropertyHandler // if set, the property will be settable
 	node         Node
+	qos          *byte
+	format       string
+	unit         string
+	retained     *bool
+	settable     *bool
+	base         Property // definition of array instance properties
+	meta         metadata
+	tags         tags
+
+	mutex         sync.Mutex // guards value, initial value, throttle, deadband and interval
+	valueSet      bool       // SetValue was called, unset values are not published on connect
+	initial       *string    // published while no value is set
+	published     *string    // last published value
+	deadband      float64
+	throttle      time.Duration
+	lastPublish   time.Time
+	throttleTimer *time.Timer // pending publish of the latest value
+	interval      time.Duration
+
+	publishMutex sync.Mutex // serializes reading and sending the value, the last publish carries the stored value
+}
+
+// clone returns a copy of the property definition and value, not attached to a node and never published
+func (p *property) clone() *property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c := &property{
+		name:         p.name,
+		displayName:  p.displayName,
+		propertyType: p.propertyType,
+		value:        p.value,
+		valueSet:     p.valueSet,
+		initial:      p.initial,
+		handler:      p.handler,
+		format:       p.format,
+		unit:         p.unit,
+		meta:         p.meta.clone(),
+		tags:         append(tags(nil), p.tags...),
+		deadband:     p.deadband,
+		throttle:     p.throttle,
+		interval:     p.interval,
+	}
+	if p.qos != nil {
+		qos := *p.qos
+		c.qos = &qos
+	}
+	if p.retained != nil {
+		retained := *p.retained
+		c.retained = &retained
+	}
+	if p.settable != nil {
+		settable := *p.settable
+		c.settable = &settable
+	}
+	return c
 }
 
 func (p *property) Name() string {
 	return p.name
 }
 
+func (p *property) DisplayName() string {
+	if p.displayName == "" && p.base != nil {
+		return p.base.DisplayName()
+	}
+	if p.displayName == "" {
+		return p.name
+	}
+	return p.displayName
+}
+
+func (p *property) SetName(name string) Property {
+	p.displayName = name
+	return p
+}
+
 func (p *property) Type() string {
 	return p.propertyType
 }
 
 func (p *property) Value() string {
-	return p.value
+	p.mutex.Lock()
+	value, valueSet := p.value, p.valueSet
+	p.mutex.Unlock()
+	if !valueSet {
+		if initial, found := p.InitialValue(); found {
+			return initial
+		}
+	}
+	return value
 }
 
 func (p *property) SetValue(value string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 	p.value = value
+	p.valueSet = true
+	return p
+}
+
+func (p *property) InitialValue() (string, bool) {
+	p.mutex.Lock()
+	initial := p.initial
+	p.mutex.Unlock()
+	if initial == nil && p.base != nil {
+		return p.base.InitialValue()
+	}
+	if initial == nil {
+		return "", false
+	}
+	return *initial, true
+}
+
+func (p *property) SetInitialValue(value string) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.initial = &value
+	return p
+}
+
+// hasValue returns true if a value or an initial value is set
+func (p *property) hasValue() bool {
+	p.mutex.Lock()
+	valueSet := p.valueSet
+	p.mutex.Unlock()
+	if valueSet {
+		return true
+	}
+	_, found := p.InitialValue()
+	return found
+}
+
+func (p *property) SetDeadband(delta float64) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deadband = delta
+	return p
+}
+
+// inDeadband returns true if value is a number within deadband of the last published value
+func (p *property) inDeadband(value string) bool {
+	if dt := p.Datatype(); dt != Integer && dt != Float {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.deadband <= 0 || p.published == nil {
+		return false
+	}
+	last, err := strconv.ParseFloat(*p.published, 64)
+	if err != nil {
+		return false
+	}
+	current, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+	return math.Abs(current-last) < p.deadband
+}
+
+func (p *property) SetThrottle(interval time.Duration) Property {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.throttle = interval
 	return p
 }
 
+func (p *property) PublishInterval() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.interval
+}
+
+func (p *property) SetPublishInterval(interval time.Duration) Property {
+	p.mutex.Lock()
+	p.interval = interval
+	p.mutex.Unlock()
+	if p.node == nil || p.node.Device() == nil {
+		return p
+	}
+	if d, ok := p.node.Device().(interface{ restartIntervals() }); ok {
+		d.restartIntervals()
+	}
+	return p
+}
+
+func (p *property) Set(value string) error {
+	if err := p.Datatype().ValidateFormat(p.Format(), value); err != nil {
+		return err
+	}
+	p.SetValue(value)
+	if p.inDeadband(value) {
+		return nil
+	}
+	p.publishThrottled()
+	return nil
+}
+
+// publishThrottled publish current value if connected, delayed to the end of the throttle interval if needed
+func (p *property) publishThrottled() {
+	p.mutex.Lock()
+	if p.throttle > 0 {
+		if p.throttleTimer != nil {
+			// pending publish will send the latest value
+			p.mutex.Unlock()
+			return
+		}
+		if wait := p.throttle - time.Since(p.lastPublish); wait > 0 {
+			p.throttleTimer = time.AfterFunc(wait, func() {
+				p.mutex.Lock()
+				p.throttleTimer = nil
+				p.mutex.Unlock()
+				p.publishThrottled()
+			})
+			p.mutex.Unlock()
+			return
+		}
+		p.lastPublish = time.Now()
+	}
+	p.mutex.Unlock()
+	if client := p.node.Device().Client(); client != nil && client.IsConnected() {
+		p.Publish()
+	}
+}
+
+func (p *property) SetJSON(v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.Set(string(value))
+}
+
+func (p *property) GetJSON(out interface{}) error {
+	return json.Unmarshal([]byte(p.Value()), out)
+}
+
+func (p *property) SetBool(value bool) error {
+	p.SetDatatype(Boolean)
+	return p.Set(strconv.FormatBool(value))
+}
+
+func (p *property) Bool() (bool, error) {
+	value := p.Value()
+	if err := Boolean.Validate(value); err != nil {
+		return false, err
+	}
+	return value == "true", nil
+}
+
+func (p *property) SetPercent(v float64) error {
+	dt := p.Datatype()
+	if dt != Integer {
+		dt = Float
+	}
+	format := p.Format()
+	if _, _, err := parseRange(format); err != nil {
+		format = "0:100"
+	}
+	value := strconv.FormatFloat(v, 'f', -1, 64)
+	if err := dt.ValidateFormat(format, value); err != nil {
+		return err
+	}
+	p.SetDatatype(dt).SetFormat(format).SetUnit("%")
+	return p.Set(value)
+}
+
+func (p *property) SetEnum(values []string) Property {
+	var options []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			seen[v] = true
+			options = append(options, v)
+		}
+	}
+	return p.SetDatatype(Enum).SetFormat(strings.Join(options, ","))
+}
+
+func (p *property) SetEnumValue(v string) error {
+	if p.Datatype() != Enum {
+		return fmt.Errorf("property %s is not an enum: %s", p.name, p.Datatype())
+	}
+	if p.Format() == "" {
+		return fmt.Errorf("property %s has no enum values", p.name)
+	}
+	return p.Set(v)
+}
+
+func (p *property) SetRGB(r, g, b uint8) error {
+	p.SetDatatype(Color).SetFormat("rgb")
+	return p.Set(RGB{R: r, G: g, B: b}.String())
+}
+
+func (p *property) SetHSV(h, s, v int) error {
+	value := HSV{H: h, S: s, V: v}.String()
+	if err := Color.ValidateFormat("hsv", value); err != nil {
+		return err
+	}
+	p.SetDatatype(Color).SetFormat("hsv")
+	return p.Set(value)
+}
+
+func (p *property) RGB() (RGB, error) {
+	return ParseRGB(p.Value())
+}
+
+func (p *property) HSV() (HSV, error) {
+	return ParseHSV(p.Value())
+}
+
+func (p *property) Datatype() Datatype {
+	if p.base != nil {
+		return p.base.Datatype()
+	}
+	return Datatype(p.propertyType)
+}
+
+func (p *property) SetDatatype(dt Datatype) Property {
+	p.propertyType = string(dt)
+	return p
+}
+
+func (p *property) Format() string {
+	if p.base != nil {
+		return p.base.Format()
+	}
+	return p.format
+}
+
+func (p *property) SetFormat(format string) Property {
+	p.format = format
+	return p
+}
+
+func (p *property) Unit() string {
+	return p.unit
+}
+
+func (p *property) SetUnit(unit string) Property {
+	p.unit = unit
+	return p
+}
+
+func (p *property) Retained() bool {
+	if p.base != nil {
+		return p.base.Retained()
+	}
+	return p.retained == nil || *p.retained
+}
+
+func (p *property) SetRetained(retained bool) Property {
+	p.retained = &retained
+	return p
+}
+
+func (p *property) SetMeta(key string, value string) Property {
+	p.meta.set(key, value)
+	return p
+}
+
+func (p *property) AddTag(tag string) Property {
+	p.tags.add(tag)
+	return p
+}
+
+func (p *property) Tags() []string {
+	if p.base != nil {
+		return p.base.Tags()
+	}
+	return append([]string(nil), p.tags...)
+}
+
 func (p *property) Node() Node {
 	return p.node
 }
@@ -59,7 +506,33 @@ func (p *property) SetNode(n Node) Property {
 	p.node = n
 	return p
 }
+func (p *property) PublishQoS() byte {
+	if p.qos == nil {
+		return p.node.Device().Config().qos()
+	}
+	return *p.qos
+}
+func (p *property) SetPublishQoS(qos byte) Property {
+	p.qos = &qos
+	return p
+}
+func (p *property) Settable() bool {
+	if p.settable == nil && p.base != nil {
+		return p.base.Settable()
+	}
+	if p.settable == nil {
+		return p.Handler() != nil
+	}
+	return *p.settable
+}
+func (p *property) SetSettable(settable bool) Property {
+	p.settable = &settable
+	return p
+}
 func (p *property) Handler() PropertyHandler {
+	if p.handler == nil && p.base != nil {
+		return p.base.Handler()
+	}
 	return p.handler
 }
 func (p *property) SetHandler(h PropertyHandler) Property {
@@ -67,26 +540,105 @@ func (p *property) SetHandler(h PropertyHandler) Property {
 	return p
 }
 
+func (p *property) OnSet(handler func(value string) error) Property {
+	return p.SetHandler(func(p Property, payload []byte, topic string) (bool, error) {
+		value := string(payload)
+		if err := handler(value); err != nil {
+			return false, err
+		}
+		p.SetValue(value)
+		p.Publish()
+		return true, nil
+	})
+}
+
 func (p *property) Publish() Property {
-	p.node.Device().SendMessage(p.Node().NodeTopic(p.name), p.value)
+	if length := p.node.ArrayLength(); length > 0 {
+		// fan out to array instances
+		for i := 0; i < length; i++ {
+			p.node.Index(i).GetProperty(p.name).
+				SetValue(p.Value()).
+				Publish()
+		}
+		return p
+	}
+	if n, ok := p.node.(interface{ ensureMetadata() }); ok && p.node.Device().Config().LazyMetadata {
+		n.ensureMetadata()
+	}
+	p.publishMutex.Lock()
+	defer p.publishMutex.Unlock()
+	value := p.Value()
+	p.mutex.Lock()
+	p.published = &value
+	p.mutex.Unlock()
+	p.node.Device().Publish(p.node.NodeTopic(p.name), PublishOptions{
+		Payload:  value,
+		QoS:      p.PublishQoS(),
+		Retained: p.Retained(),
+	})
+	return p
+}
+
+func (p *property) Topic(part string) string {
+	if part == "" {
+		return p.node.Topic(p.name)
+	}
+	return p.node.Topic(p.name + "/" + part)
+}
+
+func (p *property) PublishAttributes() Property {
+	p.node.Device().SendMessage(p.node.NodeTopic(p.name+"/$name"), p.DisplayName())
+	if p.propertyType != "" {
+		p.node.Device().SendMessage(p.node.NodeTopic(p.name+"/$datatype"), p.propertyType)
+	}
+	if p.format != "" {
+		p.node.Device().SendMessage(p.node.NodeTopic(p.name+"/$format"), p.format)
+	}
+	if p.unit != "" {
+		p.node.Device().SendMessage(p.node.NodeTopic(p.name+"/$unit"), p.unit)
+	}
+	if p.retained != nil {
+		p.node.Device().SendMessage(p.node.NodeTopic(p.name+"/$retained"), fmt.Sprintf("%t", *p.retained))
+	}
+	p.node.Device().SendMessage(p.node.NodeTopic(p.name+"/$settable"), fmt.Sprintf("%t", p.Settable()))
+	p.meta.publish(p.node.Device(), p.node.NodeTopic(p.name+"/"))
+	p.tags.publish(p.node.Device(), p.node.NodeTopic(p.name+"/"))
 	return p
 }
 
 func (p *property) Subscribe() Property {
-	if p.Handler() == nil {
+	if !p.Settable() {
 		return p
 	}
-	topic := p.Node().Device().Topic(p.Node().NodeTopic(fmt.Sprintf("%s/set", p.name)))
-	p.node.Device().Client().Subscribe(topic, 1, func(client mqtt.Client, message mqtt.Message) {
+	token := p.node.Device().Client().Subscribe(p.Topic("set"), p.node.Device().Config().qos(), func(client mqtt.Client, message mqtt.Message) {
 		p.onMessage(message.Topic(), message.Payload())
 	})
+	watchSubscribe(p.node.Device(), p.Topic("set"), token)
 	return p
 }
 
 func (p *property) onMessage(topic string, payload []byte) {
+	logger := p.node.Device().Config().logger()
+	if !p.Settable() {
+		logger.Errorf("Property is not settable: %s, topic: %s", p.name, topic)
+		return
+	}
+	if err := p.Datatype().ValidateFormat(p.Format(), string(payload)); err != nil {
+		logger.Warnf("Rejected value for property: %s, topic: %s, %v", p.name, topic, err)
+		return
+	}
+	logger.Debugf("Received value for property: %s, topic: %s", p.name, topic)
 	if p.Handler() == nil {
-		log.Fatalf("No handler for property: %s, topic: %s", p.name, topic)
+		p.SetValue(string(payload))
+		p.Publish()
+		return
+	}
+	confirmed, err := p.Handler()(p, payload, topic)
+	if err != nil {
+		logger.Warnf("Handler failed for property: %s, topic: %s, %v", p.name, topic, err)
 		return
 	}
-	p.handler(p, payload, topic)
+	if confirmed {
+		p.SetValue(string(payload))
+	}
 }
@@ -107,6 +107,7 @@ func NewPeriodicPublisher(period time.Duration) PeriodicPublisher {
 }
 
 // NewDevicePublisher create default device publisher to publish device stats (uptime)
+// Device.Run already publishes stats every StatsReportInterval, use this only when connecting with Device.Connect
 func NewDevicePublisher(d Device) PeriodicPublisher {
 	p := NewPeriodicPublisher(time.Duration(d.Config().StatsReportInterval) * time.Second)
 	p.SetDevicePublisher(d, func(d Device) {
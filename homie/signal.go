@@ -0,0 +1,34 @@
+package homie
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifySignals relay signals to c, replaced in tests
+var notifySignals = signal.Notify
+
+// RunUntilSignal connect, publish stats periodically and block until one of signals is received, then disconnect
+// gracefully, signals default to SIGINT and SIGTERM
+func RunUntilSignal(d Device, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	received := make(chan os.Signal, 1)
+	notifySignals(received, signals...)
+	defer signal.Stop(received)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-received:
+			d.Config().logger().Infof("Device %s received %v, disconnecting", d.Name(), sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return d.RunContext(ctx)
+}
@@ -0,0 +1,30 @@
+package homie
+
+import (
+	"strings"
+)
+
+// tags labels of a node or property for controller grouping, published as <prefix>$tags, comma separated
+type tags []string
+
+// add append tag, empty and duplicate tags are ignored
+func (t *tags) add(tag string) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return
+	}
+	for _, existing := range *t {
+		if existing == tag {
+			return
+		}
+	}
+	*t = append(*t, tag)
+}
+
+// publish send $tags, topics are relative to the owner like metadata, not published if there is no tag
+func (t tags) publish(d Device, prefix string) {
+	if len(t) == 0 {
+		return
+	}
+	d.SendMessage(prefix+"$tags", strings.Join(t, ","))
+}
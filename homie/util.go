@@ -1,16 +1,128 @@
 package homie
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
+	"unicode"
 )
 
-func outboundIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// dialOutbound opens a UDP socket towards a public address to find the outbound interface, no packet is sent,
+// replaced in tests
+var dialOutbound = func() (net.Conn, error) {
+	return net.Dial("udp", "8.8.8.8:80")
+}
+
+// outboundIP returns the IP address of the interface used to reach the internet, an error if there is no route
+func outboundIP() (string, error) {
+	conn, err := dialOutbound()
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("can not resolve outbound IP: %v", err)
 	}
 	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP.String()
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || localAddr.IP == nil || localAddr.IP.IsUnspecified() {
+		return "", fmt.Errorf("can not resolve outbound IP from local address %v", conn.LocalAddr())
+	}
+	return localAddr.IP.String(), nil
+}
+
+// networkInterface is the part of net.Interface needed to resolve the outbound MAC address
+type networkInterface struct {
+	hardwareAddr net.HardwareAddr
+	addrs        []net.Addr
+}
+
+// listInterfaces returns the host network interfaces, replaced in tests
+var listInterfaces = func() ([]networkInterface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]networkInterface, 0, len(ifaces))
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		result = append(result, networkInterface{
+			hardwareAddr: iface.HardwareAddr,
+			addrs:        addrs,
+		})
+	}
+	return result, nil
+}
+
+// interfaceMAC returns the hardware address of the interface with ip, or empty string if not resolvable
+func interfaceMAC(ip string) string {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		for _, addr := range iface.addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.String() == ip && len(iface.hardwareAddr) > 0 {
+				return iface.hardwareAddr.String()
+			}
+		}
+	}
+	return ""
+}
+
+// ValidateID returns an *IDError if id is not a valid Homie topic id: lowercase a-z, 0-9 and hyphens,
+// not starting or ending with a hyphen
+func ValidateID(id string) error {
+	if id == "" {
+		return &IDError{ID: id, Reason: "id is empty"}
+	}
+	if strings.HasPrefix(id, "-") || strings.HasSuffix(id, "-") {
+		return &IDError{ID: id, Reason: "id must not start or end with '-'"}
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && r != '-' {
+			return &IDError{ID: id, Reason: "id must contain only a-z, 0-9 and '-'"}
+		}
+	}
+	return nil
+}
+
+// payloadBytes returns publish payload as bytes, other types than string and []byte are formatted with %v
+func payloadBytes(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case string:
+		return []byte(p)
+	case []byte:
+		return p
+	case bytes.Buffer:
+		return p.Bytes()
+	default:
+		return []byte(fmt.Sprintf("%v", p))
+	}
+}
+
+// escapeTopic returns topic level without the MQTT wildcards + and #, which would turn it into a subscription filter,
+// the error matches ErrWildcardTopic if anything was removed
+func escapeTopic(level string) (string, error) {
+	if !strings.ContainsAny(level, "+#") {
+		return level, nil
+	}
+	escaped := strings.NewReplacer("+", "", "#", "").Replace(level)
+	return escaped, fmt.Errorf("%w: %q", ErrWildcardTopic, level)
+}
+
+// ValidateNodeType returns an error if nodeType is not a valid node $type: the attribute is required and free text,
+// it must not be empty or contain control characters
+func ValidateNodeType(nodeType string) error {
+	if strings.TrimSpace(nodeType) == "" {
+		return errors.New("node type is empty")
+	}
+	for _, r := range nodeType {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("node type must not contain control characters: %q", nodeType)
+		}
+	}
+	return nil
 }
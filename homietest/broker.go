@@ -0,0 +1,282 @@
+// Package homietest provides an in-memory MQTT broker to test homie devices and controllers without a real broker
+package homietest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	homie "github.com/masgari/homie-go/homie"
+)
+
+// Message a message published to the broker
+type Message struct {
+	Topic    string
+	Payload  string
+	QoS      byte
+	Retained bool
+}
+
+// Broker in-memory broker, messages are delivered synchronously to subscribed clients and retained messages are
+// delivered on subscribe, like a real broker
+type Broker struct {
+	mutex     sync.Mutex
+	retained  map[string]string
+	published []Message
+	clients   []*client
+}
+
+// NewBroker create an empty broker
+func NewBroker() *Broker {
+	return &Broker{
+		retained: make(map[string]string),
+	}
+}
+
+// ClientFactory returns a factory connecting clients to the broker, set it as homie.MqttConfig.ClientFactory
+func (b *Broker) ClientFactory() homie.MqttClientFactory {
+	return func(options *mqtt.ClientOptions) homie.MqttAdapter {
+		c := &client{
+			broker:        b,
+			options:       options,
+			subscriptions: make(map[string]mqtt.MessageHandler),
+		}
+		b.mutex.Lock()
+		b.clients = append(b.clients, c)
+		b.mutex.Unlock()
+		return c
+	}
+}
+
+// Retained returns retained payload of topic, false if no message is retained
+func (b *Broker) Retained(topic string) (string, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	payload, found := b.retained[topic]
+	return payload, found
+}
+
+// RetainedTopics returns sorted topics with a retained message matching filter, filter may contain + and # wildcards
+func (b *Broker) RetainedTopics(filter string) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var topics []string
+	for topic := range b.retained {
+		if TopicMatches(filter, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Messages returns messages published on topics matching filter, in publish order
+func (b *Broker) Messages(filter string) []Message {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var messages []Message
+	for _, m := range b.published {
+		if TopicMatches(filter, m.Topic) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Inject publish a non retained message as if sent by another client, e.g. device/node/prop/set
+func (b *Broker) Inject(topic string, payload string) {
+	b.publish(Message{Topic: topic, Payload: payload})
+}
+
+// Drop simulate lost connections, wills of connected clients are published and OnConnectionLost handlers called
+func (b *Broker) Drop() {
+	b.mutex.Lock()
+	clients := append([]*client{}, b.clients...)
+	b.mutex.Unlock()
+	for _, c := range clients {
+		if !c.disconnect() {
+			continue
+		}
+		if c.options.WillEnabled {
+			b.publish(Message{
+				Topic:    c.options.WillTopic,
+				Payload:  string(c.options.WillPayload),
+				QoS:      c.options.WillQos,
+				Retained: c.options.WillRetained,
+			})
+		}
+		if c.options.OnConnectionLost != nil {
+			c.options.OnConnectionLost(nil, fmt.Errorf("connection dropped by broker"))
+		}
+	}
+}
+
+func (b *Broker) publish(m Message) {
+	b.mutex.Lock()
+	b.published = append(b.published, m)
+	if m.Retained {
+		if m.Payload == "" {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m.Payload
+		}
+	}
+	clients := append([]*client{}, b.clients...)
+	b.mutex.Unlock()
+	// handlers are called without lock as they may publish
+	for _, c := range clients {
+		for _, handler := range c.handlers(m.Topic) {
+			handler(nil, &message{topic: m.Topic, payload: []byte(m.Payload), qos: m.QoS})
+		}
+	}
+}
+
+// TopicMatches returns true if topic matches filter, filter may contain + and # wildcards
+func TopicMatches(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) || (part != "+" && part != topicParts[i]) {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+type client struct {
+	broker        *Broker
+	options       *mqtt.ClientOptions
+	mutex         sync.Mutex
+	connected     bool
+	subscriptions map[string]mqtt.MessageHandler
+}
+
+func (c *client) Connect() mqtt.Token {
+	c.mutex.Lock()
+	c.connected = true
+	c.mutex.Unlock()
+	if c.options.OnConnect != nil {
+		c.options.OnConnect(nil)
+	}
+	return &token{}
+}
+
+func (c *client) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+func (c *client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if !c.IsConnected() {
+		return &token{err: fmt.Errorf("not connected")}
+	}
+	var data string
+	switch p := payload.(type) {
+	case string:
+		data = p
+	case []byte:
+		data = string(p)
+	case bytes.Buffer:
+		data = p.String()
+	default:
+		return &token{err: fmt.Errorf("unknown payload type %T", payload)}
+	}
+	c.broker.publish(Message{Topic: topic, Payload: data, QoS: qos, Retained: retained})
+	return &token{}
+}
+
+func (c *client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.mutex.Lock()
+	c.subscriptions[topic] = callback
+	c.mutex.Unlock()
+	c.broker.mutex.Lock()
+	var retained []Message
+	for t, payload := range c.broker.retained {
+		if TopicMatches(topic, t) {
+			retained = append(retained, Message{Topic: t, Payload: payload, Retained: true})
+		}
+	}
+	c.broker.mutex.Unlock()
+	sort.Slice(retained, func(i, j int) bool { return retained[i].Topic < retained[j].Topic })
+	for _, m := range retained {
+		callback(nil, &message{topic: m.Topic, payload: []byte(m.Payload), retained: true})
+	}
+	return &token{}
+}
+
+func (c *client) Unsubscribe(topics ...string) mqtt.Token {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, topic := range topics {
+		delete(c.subscriptions, topic)
+	}
+	return &token{}
+}
+
+func (c *client) Disconnect(quiesce uint) {
+	c.disconnect()
+}
+
+// disconnect returns true if the client was connected
+func (c *client) disconnect() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	connected := c.connected
+	c.connected = false
+	return connected
+}
+
+func (c *client) handlers(topic string) []mqtt.MessageHandler {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.connected {
+		return nil
+	}
+	var handlers []mqtt.MessageHandler
+	for filter, handler := range c.subscriptions {
+		if TopicMatches(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+// token of an operation completed synchronously
+type token struct {
+	err error
+}
+
+func (t *token) Wait() bool {
+	return true
+}
+
+func (t *token) WaitTimeout(_ time.Duration) bool {
+	return true
+}
+
+func (t *token) Error() error {
+	return t.err
+}
+
+type message struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	retained bool
+}
+
+func (m *message) Duplicate() bool   { return false }
+func (m *message) Qos() byte         { return m.qos }
+func (m *message) Retained() bool    { return m.retained }
+func (m *message) Topic() string     { return m.topic }
+func (m *message) MessageID() uint16 { return 0 }
+func (m *message) Payload() []byte   { return m.payload }
+func (m *message) Ack()              {}
@@ -0,0 +1,120 @@
+package homietest
+
+import (
+	"testing"
+
+	homie "github.com/masgari/homie-go/homie"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestConfig(broker *Broker) *homie.Config {
+	return &homie.Config{
+		Mqtt: homie.MqttConfig{
+			URL:           "tcp://localhost:1883/",
+			ClientFactory: broker.ClientFactory(),
+		},
+		BaseTopic:           "homie/",
+		StatsReportInterval: 60,
+	}
+}
+
+func TestDeviceTree(t *testing.T) {
+	broker := NewBroker()
+	device := homie.NewDevice("thermostat", newTestConfig(broker))
+	device.NewNode("heater", "Heater").
+		NewProperty("target", "float").
+		SetUnit("°C").
+		SetValue("21.5").
+		OnSet(func(value string) error { return nil })
+	assert.NoError(t, device.Connect())
+
+	for topic, expected := range map[string]string{
+		"homie/thermostat/$homie":                  homie.HomieSpecVersion,
+		"homie/thermostat/$state":                  homie.StateReady,
+		"homie/thermostat/$nodes":                  "heater",
+		"homie/thermostat/heater/$type":            "Heater",
+		"homie/thermostat/heater/$properties":      "target",
+		"homie/thermostat/heater/target":           "21.5",
+		"homie/thermostat/heater/target/$unit":     "°C",
+		"homie/thermostat/heater/target/$datatype": "float",
+	} {
+		value, found := broker.Retained(topic)
+		assert.True(t, found, topic)
+		assert.Equal(t, expected, value, topic)
+	}
+	assert.Contains(t, broker.RetainedTopics("homie/thermostat/#"), "homie/thermostat/$stats/uptime")
+
+	broker.Inject("homie/thermostat/heater/target/set", "19")
+	value, _ := broker.Retained("homie/thermostat/heater/target")
+	assert.Equal(t, "19", value)
+
+	assert.NoError(t, device.Disconnect())
+	value, _ = broker.Retained("homie/thermostat/$state")
+	assert.Equal(t, homie.StateDisconnected, value)
+}
+
+func TestDropPublishesWill(t *testing.T) {
+	broker := NewBroker()
+	device := homie.NewDevice("sensor", newTestConfig(broker))
+	lost := false
+	device.AddConnectionLostHandler(func(device homie.Device, err error) { lost = true })
+	assert.NoError(t, device.Connect())
+
+	broker.Drop()
+	assert.True(t, lost)
+	assert.False(t, device.IsConnected())
+	value, _ := broker.Retained("homie/sensor/$state")
+	assert.Equal(t, homie.StateLost, value)
+}
+
+func TestControllerDiscovery(t *testing.T) {
+	broker := NewBroker()
+	device := homie.NewDevice("lamp", newTestConfig(broker))
+	device.NewNode("light", "Light").NewProperty("on", "boolean").SetValue("true")
+	assert.NoError(t, device.Connect())
+
+	controller := homie.NewController("controller", newTestConfig(broker))
+	assert.NoError(t, controller.Connect())
+	devices := controller.Devices()
+	if assert.Len(t, devices, 1) {
+		assert.Equal(t, "lamp", devices[0].ID)
+		assert.Equal(t, homie.StateReady, devices[0].State())
+		assert.Equal(t, "true", devices[0].Nodes["light"].Properties["on"].Value)
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	assert.True(t, TopicMatches("a/+/c", "a/b/c"))
+	assert.True(t, TopicMatches("a/#", "a/b/c"))
+	assert.True(t, TopicMatches("a/b", "a/b"))
+	assert.False(t, TopicMatches("a/+", "a/b/c"))
+	assert.False(t, TopicMatches("a/b/c", "a/b"))
+}
+
+func TestControllerRefresh(t *testing.T) {
+	broker := NewBroker()
+	device := homie.NewDevice("boiler", newTestConfig(broker))
+	device.NewNode("burner", "Burner").NewProperty("power", "integer").SetValue("40")
+	assert.NoError(t, device.Connect())
+
+	controller := homie.NewController("controller", newTestConfig(broker))
+	assert.NoError(t, controller.Connect())
+	snapshot, err := controller.Refresh("boiler")
+	assert.NoError(t, err)
+	assert.Equal(t, "boiler", snapshot.ID)
+	assert.Equal(t, homie.StateReady, snapshot.State())
+	assert.Equal(t, "40", snapshot.Nodes["burner"].Properties["power"].Value)
+	assert.Equal(t, "integer", snapshot.Nodes["burner"].Properties["power"].Attributes["$datatype"])
+
+	// the discovered model keeps following the device after a refresh
+	device.NewNode("pump", "Pump")
+	devices := controller.Devices()
+	if assert.Len(t, devices, 1) {
+		assert.Contains(t, devices[0].Nodes, "pump")
+	}
+
+	_, err = controller.Refresh("unknown")
+	assert.Error(t, err)
+	assert.NotContains(t, broker.clients[len(broker.clients)-1].subscriptions, "homie/unknown/#")
+	assert.Contains(t, broker.clients[len(broker.clients)-1].subscriptions, "homie/boiler/#")
+}